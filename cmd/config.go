@@ -0,0 +1,483 @@
+/*
+Copyright © 2024 0x07cf-dev <0x07cf@pm.me>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/0x07cf-dev/go-backup/internal/backup"
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	"github.com/0x07cf-dev/go-backup/internal/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var configHost string
+var configAll bool
+var configRaw bool
+var configPattern bool
+
+var validateRemote string
+var validateJSON bool
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspects and edits the configuration file",
+	Long: `Inspects and edits the configuration file, without running any backup.
+Edits apply to the entry of this machine, or of another one with --host, which may also be a hostname pattern.
+The entry of a pattern matching the machine is shared with other machines, so it's only edited with --pattern.
+Entries with tags only match if the machine has them all, given with --tags or in $GOBACKUP_TAGS.
+The file is written back atomically, leaving the other machines as they were.`,
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Checks the configuration file for mistakes",
+	Long: `Checks the configuration file: its syntax, unknown or misspelled fields, values of the wrong type,
+and values that make no sense, like invalid durations, broken scripts or commands needing unknown ones.
+The paths of this machine, or of another one with --host, must exist.
+Problems are printed with their line and column; the exit code is 1 if the configuration is invalid.
+
+  go-backup config validate
+  go-backup config validate .go-backup.json --remote MyDrive --host Debian01`,
+	Args:        cobra.MaximumNArgs(1),
+	Annotations: map[string]string{"config": "optional"},
+	Run: func(cmd *cobra.Command, args []string) {
+		file := configFile
+		if len(args) > 0 {
+			file = args[0]
+		}
+		if file == "" {
+			// Look for the file where it would be used from
+			_ = viper.ReadInConfig()
+			file = viper.ConfigFileUsed()
+		}
+		if file == "" {
+			logger.Fatal("No configuration file found.")
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+
+		v := config.Validate(data, config.ValidateOpts{
+			Hostname:  configHostname(),
+			Tags:      config.HostTags(),
+			Remote:    validateRemote,
+			IsBuiltin: isBuiltin,
+		})
+		if v.Config != nil {
+			for i, m := range v.Config.Machines {
+				if m == nil {
+					continue
+				}
+				if _, err := backup.NewFaultInjector(m.Faults); err != nil {
+					v.Add(fmt.Sprintf("machines[%d].faults", i), err.Error())
+				}
+			}
+			v.Sort()
+		}
+
+		if validateJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			problems := v.Problems
+			if problems == nil {
+				problems = []config.Problem{}
+			}
+			if err := enc.Encode(problems); err != nil {
+				logger.Fatal(err.Error())
+			}
+		} else {
+			errs, warnings := 0, 0
+			for _, p := range v.Problems {
+				fmt.Printf("%s:%s\n", file, p)
+				if p.Warning {
+					warnings++
+				} else {
+					errs++
+				}
+			}
+			if errs == 0 {
+				fmt.Printf("%s is valid (%d warnings)\n", file, warnings)
+			} else {
+				fmt.Printf("%s is not valid: %d errors, %d warnings\n", file, errs, warnings)
+			}
+		}
+
+		if v.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+// configSchemaCmd represents the config schema command
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Prints the JSON schema of the configuration file",
+	Long: `Prints the JSON schema of the configuration file, for editors that complete and check it.
+
+  go-backup config schema > go-backup.schema.json`,
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{"config": "optional"},
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Stdout.Write(config.Schema)
+	},
+}
+
+// configShowCmd represents the config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the configuration of a machine",
+	Long: `Prints the configuration of this machine, of another one with --host, or the whole file with --all.
+The machine's configuration is printed as it runs with: matched by its hostname or a pattern,
+with the profiles it extends merged in. Use --raw to print it as it's written instead.
+
+  go-backup config show
+  go-backup config show --host web-07 --raw`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		global := loadConfig()
+
+		var v any = global
+		if !configAll {
+			m := configuredMachine(global)
+			if m.Hostname != configHostname() {
+				logger.Debugf("%s matches %s", configHostname(), m.Hostname)
+			}
+			v = m
+			if !configRaw {
+				resolved, err := global.Resolve(m, configHostname())
+				if err != nil {
+					logger.Fatal(err.Error())
+				}
+				v = resolved
+			}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+// configPathCmd represents the config path command
+var configPathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Adds or removes the paths of a machine",
+}
+
+var configPathAddCmd = &cobra.Command{
+	Use:   "add <path>...",
+	Short: "Adds paths to back up",
+	Long: `Adds paths to back up. Relative paths are made absolute, unless they refer to environment variables.
+The machine is added to the configuration if it isn't there yet.
+
+  go-backup config path add /etc/nginx ~/Documents
+  go-backup config path add '$HOME/.ssh' --host Debian01`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			m, err := editedMachine(global, true)
+			if err != nil {
+				return err
+			}
+			for _, path := range args {
+				if !filepath.IsAbs(path) && !strings.ContainsAny(path, "$%") {
+					abs, err := filepath.Abs(path)
+					if err != nil {
+						return err
+					}
+					path = abs
+				}
+				if err := m.AddPath(path); err != nil {
+					return err
+				}
+				if expanded, err := utils.CleanPath(path); err == nil && m.Hostname == thisHostname() && !exists(expanded) {
+					logger.Warnf("'%s' doesn't exist yet.", path)
+				}
+				logger.Infof("Added path to %s: %s", m.Hostname, path)
+			}
+			return nil
+		})
+	},
+}
+
+var configPathRemoveCmd = &cobra.Command{
+	Use:   "remove <path>...",
+	Short: "Removes paths, along with their commands",
+	Long: `Removes paths, along with their commands. Files already backed up are left on the remote.
+
+  go-backup config path remove /etc/nginx`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			m, err := editedMachine(global, false)
+			if err != nil {
+				return err
+			}
+			for _, path := range args {
+				if err := m.RemovePath(path); err != nil {
+					return err
+				}
+				logger.Infof("Removed path from %s: %s", m.Hostname, path)
+			}
+			return nil
+		})
+	},
+}
+
+// configPreCmd represents the config pre command
+var configPreCmd = &cobra.Command{
+	Use:   "pre",
+	Short: "Adds commands to run before the transfers",
+}
+
+var configPreAddCmd = &cobra.Command{
+	Use:   "add <command>",
+	Short: "Adds a command to run before the transfers",
+	Long: `Adds a command to run before the transfers, after those already configured.
+It's written as a plain string, which is split on '&' and run by the system shell.
+
+  go-backup config pre add 'pg_dump -U postgres -f /var/backups/db.sql'`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			m, err := editedMachine(global, true)
+			if err != nil {
+				return err
+			}
+			m.Pre = append(m.Pre, config.NewCommand(args[0]))
+			logger.Infof("Added pre command to %s: %s", m.Hostname, args[0])
+			return nil
+		})
+	},
+}
+
+// configPostCmd represents the config post command
+var configPostCmd = &cobra.Command{
+	Use:   "post",
+	Short: "Adds commands to run after the transfers",
+}
+
+var configPostAddCmd = &cobra.Command{
+	Use:   "add <command>",
+	Short: "Adds a command to run after the transfers",
+	Long: `Adds a command to run after the transfers, after those already configured.
+It's written as a plain string, which is split on '&' and run by the system shell.
+
+  go-backup config post add 'rm /var/backups/db.sql'`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			m, err := editedMachine(global, true)
+			if err != nil {
+				return err
+			}
+			m.Post = append(m.Post, config.NewCommand(args[0]))
+			logger.Infof("Added post command to %s: %s", m.Hostname, args[0])
+			return nil
+		})
+	},
+}
+
+// configMachineCmd represents the config machine command
+var configMachineCmd = &cobra.Command{
+	Use:   "machine",
+	Short: "Lists, renames or removes the configured machines",
+}
+
+var configMachineListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the configured machines",
+	Long: `Lists the configured machines, with how many paths and commands they have and their jobs, not counting those of their profiles.
+The entry matching this machine, with the tags given with --tags or in $GOBACKUP_TAGS, is marked with '*'.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		global := loadConfig()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tHOSTNAME\tTAGS\tPATHS\tPRE\tPOST\tJOBS\tEXTENDS")
+		this := global.Match(thisHostname(), config.HostTags())
+		for _, m := range global.Machines {
+			if m == nil {
+				continue
+			}
+			current := ""
+			if m == this {
+				current = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", current, m.Hostname, strings.Join(m.Tags, ", "), len(m.Paths), len(m.Pre), len(m.Post), strings.Join(m.JobNames(), ", "), strings.Join(m.Extends, ", "))
+		}
+		w.Flush()
+	},
+}
+
+var configMachineRenameCmd = &cobra.Command{
+	Use:   "rename <hostname> <new hostname>",
+	Short: "Changes the hostname of a machine",
+	Long: `Changes the hostname of a machine, for instance after the machine itself was renamed.
+Files already backed up stay on the remote under the old hostname.
+
+  go-backup config machine rename Debian01 Debian02`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			if err := global.RenameMachine(args[0], args[1]); err != nil {
+				return err
+			}
+			logger.Infof("Renamed machine %s to %s", args[0], args[1])
+			return nil
+		})
+	},
+}
+
+var configMachineRemoveCmd = &cobra.Command{
+	Use:   "remove <hostname>",
+	Short: "Removes a machine from the configuration",
+	Long: `Removes a machine from the configuration. Files already backed up are left on the remote.
+
+  go-backup config machine remove Debian01`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		editConfig(func(global *config.GlobalConfig) error {
+			if err := global.RemoveMachine(args[0]); err != nil {
+				return err
+			}
+			logger.Infof("Removed machine %s", args[0])
+			return nil
+		})
+	},
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// thisHostname returns the hostname of this machine.
+func thisHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return hostname
+}
+
+// configHostname returns the machine given with --host, or this one.
+func configHostname() string {
+	if configHost != "" {
+		return configHost
+	}
+	return thisHostname()
+}
+
+// configuredMachine returns the entry matching the machine given with --host, or this one, which must be configured.
+func configuredMachine(global *config.GlobalConfig) *config.Machine {
+	m := global.Match(configHostname(), config.HostTags())
+	if m == nil {
+		logger.Fatalf("Machine '%s' is not configured.", configHostname())
+	}
+	return m
+}
+
+// editedMachine returns the entry to edit for the machine given with --host, or this one, adding one if add is set and there's none.
+// The entry of a pattern matching the machine is shared with other machines: it's only edited with --pattern.
+func editedMachine(global *config.GlobalConfig, add bool) (*config.Machine, error) {
+	hostname := configHostname()
+	if m := global.Match(hostname, config.HostTags()); m != nil {
+		if m.Hostname == hostname {
+			return m, nil
+		}
+		if !configPattern {
+			return nil, fmt.Errorf("'%s' is configured by the pattern '%s', shared with the other machines it matches: edit it anyway with --pattern or --host '%s'", hostname, m.Hostname, m.Hostname)
+		}
+		logger.Infof("Editing the entry of the pattern '%s', shared with the other machines it matches.", m.Hostname)
+		return m, nil
+	}
+	if m := global.Machine(hostname); m != nil {
+		return m, nil
+	}
+	if !add {
+		return nil, fmt.Errorf("machine '%s' is not configured", hostname)
+	}
+	return global.AddMachine(hostname), nil
+}
+
+// loadConfig reads the config file in use.
+func loadConfig() *config.GlobalConfig {
+	global, err := config.Load(viper.ConfigFileUsed())
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return global
+}
+
+// editConfig changes the config file in use, writing it back only if every change succeeds.
+func editConfig(edit func(global *config.GlobalConfig) error) {
+	global := loadConfig()
+	if err := edit(global); err != nil {
+		logger.Fatal(err.Error())
+	}
+	if err := global.Save(viper.ConfigFileUsed()); err != nil {
+		logger.Fatalf("Error writing config file: %s", err)
+	}
+	logger.Debugf("Config file written: %s", viper.ConfigFileUsed())
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configSchemaCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configPathCmd)
+	configPathCmd.AddCommand(configPathAddCmd)
+	configPathCmd.AddCommand(configPathRemoveCmd)
+	configCmd.AddCommand(configPreCmd)
+	configPreCmd.AddCommand(configPreAddCmd)
+	configCmd.AddCommand(configPostCmd)
+	configPostCmd.AddCommand(configPostAddCmd)
+	configCmd.AddCommand(configMachineCmd)
+	configMachineCmd.AddCommand(configMachineListCmd)
+	configMachineCmd.AddCommand(configMachineRenameCmd)
+	configMachineCmd.AddCommand(configMachineRemoveCmd)
+
+	configCmd.PersistentFlags().StringVar(&configHost, "host", "", "the machine to inspect or edit (defaults to this one)")
+	configCmd.PersistentFlags().BoolVar(&configPattern, "pattern", false, "edit the entry of the hostname pattern matching the machine, shared with the other machines it matches")
+	configShowCmd.Flags().BoolVar(&configAll, "all", false, "print the whole configuration")
+	configShowCmd.Flags().BoolVar(&configRaw, "raw", false, "print the machine's configuration as it's written, without its profiles")
+	configValidateCmd.Flags().StringVar(&validateRemote, "remote", "", "a remote that must be defined in rclone's configuration")
+	configValidateCmd.Flags().BoolVar(&validateJSON, "json", false, "print the problems as JSON")
+}
+
+// isBuiltin reports whether plain commands starting with name run one of go-backup's built-ins.
+func isBuiltin(name string) bool {
+	_, ok := backup.Builtin(name)
+	return ok
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 0x07cf-dev <0x07cf@pm.me>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/0x07cf-dev/go-backup/internal/backup"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [remote]",
+	Short: "Shows what the next upload would transfer",
+	Long: `Compares every configured path with its copy on the remote, without transferring anything.
+
+  + new files, which are not on the remote yet
+  * modified files, which differ from their copy on the remote
+  - deleted files, which are only left on the remote
+
+New and modified files are the ones the next upload would transfer.`,
+	Args: remoteArg,
+	Run: func(cmd *cobra.Command, args []string) {
+		session := backup.NewSession(ctx,
+			backup.WithRemote(remoteDest),
+			backup.WithRemoteRoot(remoteRoot),
+			backup.WithJob(jobName),
+			backup.WithInteractivity(!unattended),
+			backup.WithDebug(debug),
+			backup.WithLanguage(language),
+		)
+		diff, errs := session.Diff()
+
+		symbols := map[backup.DiffKind]string{
+			backup.DiffNew:      "+",
+			backup.DiffModified: "*",
+			backup.DiffDeleted:  "-",
+		}
+		counts := make(map[backup.DiffKind]int)
+		sizes := make(map[backup.DiffKind]int64)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, e := range diff {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", symbols[e.Kind], rc_fs.SizeSuffix(e.Size), e.Path)
+			counts[e.Kind]++
+			sizes[e.Kind] += e.Size
+		}
+		w.Flush()
+
+		fmt.Printf("%d new (%s), %d modified (%s), %d deleted (%s)\n",
+			counts[backup.DiffNew], rc_fs.SizeSuffix(sizes[backup.DiffNew]),
+			counts[backup.DiffModified], rc_fs.SizeSuffix(sizes[backup.DiffModified]),
+			counts[backup.DiffDeleted], rc_fs.SizeSuffix(sizes[backup.DiffDeleted]),
+		)
+		fmt.Printf("To transfer: %d files, %s\n",
+			counts[backup.DiffNew]+counts[backup.DiffModified],
+			rc_fs.SizeSuffix(sizes[backup.DiffNew]+sizes[backup.DiffModified]),
+		)
+
+		for _, err := range errs {
+			logger.Error(err.Localize(language))
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	addJobFlag(diffCmd)
+}
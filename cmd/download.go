@@ -17,37 +17,96 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"fmt"
+	"time"
 
+	"github.com/0x07cf-dev/go-backup/internal/backup"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
 	"github.com/spf13/cobra"
 )
 
-// TODO downloadCmd represents the download command
+var target string
+var pathMaps []string
+
+var snapshotID string
+var pointInTime string
+
+// downloadCmd represents the download command
 var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Transfers from the remote to the machine",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Long: `Restores the paths configured for this machine from the remote.
+
+By default every path is restored to its original location. Use --target to place
+everything under a different root directory, and --map to relocate single prefixes:
+
+  go-backup download MyDrive --target /mnt/restore
+  go-backup download MyDrive --map /var/www=/srv/www --map /home/old=/home/new
+
+Mappings are applied first, then the result is placed under the target.
+Combine with --simulate to print the full source ---> destination plan.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+Every upload run records a snapshot on the remote. To restore the state of a
+past run instead of the latest, select it by ID or by time:
+
+  go-backup download MyDrive --snapshot 20261001T020000.483920117Z
+  go-backup download MyDrive --at 2026-10-01T02:00
+
+The available snapshots are listed when the requested one doesn't exist.`,
 	Args: remoteArg,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("download called")
+		session := backup.NewSession(ctx, restoreOpts()...)
+		session.Backup()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(downloadCmd)
+	addRestoreFlags(downloadCmd)
+}
+
+// addRestoreFlags defines the flags shared by the commands that transfer from the remote.
+func addRestoreFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&target, "target", "t", "", "restore everything under this directory instead of the original locations")
+	cmd.Flags().StringArrayVar(&pathMaps, "map", []string{}, "relocate a path prefix, in the form /old/prefix=/new/prefix (can be repeated)")
+	cmd.Flags().StringVar(&snapshotID, "snapshot", "", "restore the snapshot with this ID instead of the latest files")
+	cmd.Flags().StringVar(&pointInTime, "at", "", "restore the state as of this time (e.g. 2026-10-01T02:00)")
+	cmd.MarkFlagsMutuallyExclusive("snapshot", "at")
+	addJobFlag(cmd)
+}
 
-	// Here you will define your flags and configuration settings.
+// restoreOpts returns the session options for a transfer from the remote, as set by the user.
+func restoreOpts() []backup.BackupOptFunc {
+	var maps []backup.PathMap
+	for _, rule := range pathMaps {
+		m, err := backup.ParsePathMap(rule)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		maps = append(maps, m)
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// downloadCmd.PersistentFlags().String("foo", "", "A help for foo")
+	var at time.Time
+	if pointInTime != "" {
+		t, err := backup.ParsePointInTime(pointInTime)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		at = t
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// downloadCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	return []backup.BackupOptFunc{
+		backup.WithDownload(),
+		backup.WithRemote(remoteDest),
+		backup.WithRemoteRoot(remoteRoot),
+		backup.WithJob(jobName),
+		backup.WithTarget(target),
+		backup.WithPathMaps(maps...),
+		backup.WithSnapshot(snapshotID),
+		backup.WithPointInTime(at),
+		backup.WithFaults(injectedFaults()),
+		backup.WithSimulation(simulate),
+		backup.WithInteractivity(!unattended),
+		backup.WithDebug(debug),
+		backup.WithLanguage(language),
+	}
 }
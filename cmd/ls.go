@@ -0,0 +1,111 @@
+/*
+Copyright © 2024 0x07cf-dev <0x07cf@pm.me>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/backup"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+	"github.com/spf13/cobra"
+)
+
+var lsHost string
+var lsJSON bool
+var lsRemote string
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls [remote] [path]",
+	Short: "Lists the files backed up on the remote",
+	Long: `Lists the files backed up for this machine, or for another one with --host.
+Files are shown with the local path they were uploaded from, their size and modification time.
+The first argument is always the remote, even if it looks like a path: with --remote, the only argument is the path.
+
+  go-backup ls MyDrive
+  go-backup ls MyDrive /etc/nginx --host Debian01 --json
+  go-backup ls /etc/nginx --remote /mnt/backups`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if lsRemote != "" {
+			if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+				return err
+			}
+			return remoteArg(cmd, []string{lsRemote})
+		}
+		if err := cobra.MaximumNArgs(2)(cmd, args); err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			return remoteArg(cmd, args[:1])
+		}
+		return remoteArg(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		path := ""
+		if lsRemote != "" && len(args) > 0 {
+			path = args[0]
+		} else if len(args) > 1 {
+			path = args[1]
+		}
+
+		session := backup.NewSession(ctx,
+			backup.WithRemote(remoteDest),
+			backup.WithRemoteRoot(remoteRoot),
+			backup.WithJob(jobName),
+			backup.WithHostname(lsHost),
+			backup.WithInteractivity(!unattended),
+			backup.WithDebug(debug),
+			backup.WithLanguage(language),
+		)
+		entries, err := session.List(path)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+
+		if lsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(entries); err != nil {
+				logger.Fatal(err.Error())
+			}
+			return
+		}
+
+		var total int64
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t %s\n", rc_fs.SizeSuffix(e.Size), e.ModTime.Local().Format(time.DateTime), e.Path)
+			total += e.Size
+		}
+		w.Flush()
+		fmt.Printf("%d files, %s\n", len(entries), rc_fs.SizeSuffix(total))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	lsCmd.Flags().StringVar(&lsHost, "host", "", "list the files of another machine")
+	lsCmd.Flags().BoolVar(&lsJSON, "json", false, "print the list as JSON")
+	lsCmd.Flags().StringVar(&lsRemote, "remote", "", "the remote to list, so that the only argument is the path")
+	addJobFlag(lsCmd)
+}
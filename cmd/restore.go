@@ -0,0 +1,53 @@
+/*
+Copyright © 2024 0x07cf-dev <0x07cf@pm.me>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"github.com/0x07cf-dev/go-backup/internal/backup"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <local-path> [remote]",
+	Short: "Restores a single file or directory from the remote",
+	Long: `Restores a single file or directory, as long as it's covered by one of the paths
+configured for this machine. Nothing else is transferred, and no commands are executed.
+
+  go-backup restore /etc/nginx/nginx.conf MyDrive
+  go-backup restore /home/me/Documents/taxes MyDrive --at 2026-10-01T02:00 --target /tmp/restore
+
+The same relocation and snapshot flags as the download command are supported.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := cobra.RangeArgs(1, 2)(cmd, args); err != nil {
+			return err
+		}
+		return remoteArg(cmd, args[1:])
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		session := backup.NewSession(ctx, restoreOpts()...)
+		if err := session.Restore(args[0]); err != nil {
+			logger.Fatal(err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	addRestoreFlags(restoreCmd)
+}
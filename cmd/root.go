@@ -21,8 +21,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/0x07cf-dev/go-backup/internal/backup"
 	"github.com/0x07cf-dev/go-backup/internal/config"
 	"github.com/0x07cf-dev/go-backup/internal/lang"
 	"github.com/0x07cf-dev/go-backup/internal/logger"
@@ -48,6 +52,11 @@ var unattended bool
 var simulate bool
 var debug bool
 
+var injectFaults string
+var hostTags string
+
+var jobName string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "go-backup",
@@ -62,6 +71,18 @@ func SetVersionInfo(version, commit, date string) {
 	rootCmd.Version = fmt.Sprintf("%s (Built on %s; Git SHA: %s)", version, date, commit)
 }
 
+// injectedFaults returns the faults requested with --inject-faults, if any.
+func injectedFaults() *config.Faults {
+	if injectFaults == "" {
+		return nil
+	}
+	faults, err := backup.ParseFaults(injectFaults)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return faults
+}
+
 func remoteArg(cmd *cobra.Command, args []string) error {
 	if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
 		return err
@@ -72,6 +93,15 @@ func remoteArg(cmd *cobra.Command, args []string) error {
 		remoteDest = args[0]
 	}
 
+	// A job may have its own remote
+	if remoteDest == "" && jobName != "" {
+		job, err := config.FindJob(jobHostname(cmd), jobName)
+		if err != nil {
+			return err
+		}
+		remoteDest = job.Remote
+	}
+
 	// Validate remote
 	if v, err := config.AsValidRemote(ctx, remoteDest, unattended); err == nil {
 		remoteDest = v
@@ -81,6 +111,24 @@ func remoteArg(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// addJobFlag defines the flag selecting one of the machine's jobs.
+func addJobFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&jobName, "job", "", "use the paths, commands, remote and root of one of the machine's jobs")
+}
+
+// jobHostname returns the machine whose jobs the command can select: the one given with --host,
+// for the commands that have it, or else this one.
+func jobHostname(cmd *cobra.Command) string {
+	if host, err := cmd.Flags().GetString("host"); err == nil && host != "" {
+		return host
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return hostname
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -102,8 +150,10 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&langFile, "langFile", "", "custom language file, must end with .*.toml")
 
 	rootCmd.PersistentFlags().BoolVarP(&unattended, "unattended", "U", false, "set this to true if you're running the program automatically. User actions will not be required")
-	rootCmd.PersistentFlags().BoolVarP(&simulate, "simulate", "S", false, "simulates transfers (with fake errors)")
+	rootCmd.PersistentFlags().BoolVarP(&simulate, "simulate", "S", false, "simulates transfers, reporting what would be copied without writing anything")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enables debug logging")
+	rootCmd.PersistentFlags().StringVar(&hostTags, "tags", "", "tags of this machine, separated by commas, matching config entries with tags (defaults to $GOBACKUP_TAGS)")
+	rootCmd.PersistentFlags().StringVar(&injectFaults, "inject-faults", "", "fails paths and commands on purpose, e.g. 'path:/srv/*=UploadError,cmd:pg_dump*=CmdFailed,rate=0.2,seed=42'")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -111,7 +161,13 @@ func init() {
 }
 
 func initConfig() {
-	ctx = context.Background()
+	// Interrupting cancels the session, killing running commands: a second interrupt exits right away
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
 	// Initialize logging
 	logLevel := logger.InfoLevel
@@ -137,6 +193,11 @@ func initConfig() {
 		viper.SetConfigType("json")
 	}
 
+	// Some commands read the config file on their own, or don't need it at all
+	if configOptional() {
+		return
+	}
+
 	// Attempt reading config file
 	cfgfound := false
 	if err := viper.ReadInConfig(); err == nil {
@@ -160,7 +221,7 @@ func initConfig() {
 			}
 		} else if errors.As(err, &e2) {
 			logger.Debugf("Setting up configuration: failed to parse file %s: %s", configFile, err)
-			logger.Errorf("failed to parse file %s", configFile)
+			logger.Errorf("failed to parse file %s: run 'go-backup config validate' to find out why", viper.ConfigFileUsed())
 		} else {
 			logger.Debugf("Setting up configuration: failed to read file %s: %s", configFile, err)
 			logger.Errorf("failed to read file %s", configFile)
@@ -189,6 +250,16 @@ func initConfig() {
 		viper.AutomaticEnv()
 	}
 
+	// Keep secrets out of logs and notifications. Names can be misleading in an environment nobody chose for the backup.
+	for _, name := range logger.AddSecretVars(os.Environ()) {
+		logger.Debugf("%s is too short to be masked.", name)
+	}
+
+	// Tags given on the command line take the place of those in the environment, even if empty
+	if rootCmd.PersistentFlags().Changed("tags") {
+		config.SetHostTags(append([]string{}, config.ParseTags(hostTags)...))
+	}
+
 	// Language
 	lang.LoadLanguages(langFile, language)
 
@@ -202,16 +273,37 @@ func initConfig() {
 	logger.Debugf("----------------------------------------------------------------")
 }
 
+// configOptional reports whether the command being run can do without a working config file.
+func configOptional() bool {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	return err == nil && cmd.Annotations["config"] == "optional"
+}
+
 func loadEnvFile(path string) error {
 	if err := godotenv.Load(path); err != nil {
 		exe, err := os.Executable()
 		if err != nil {
 			return err
 		}
-		exeDir := filepath.Dir(exe)
-		if err := godotenv.Load(filepath.Join(exeDir, ".env")); err != nil {
+		path = filepath.Join(filepath.Dir(exe), ".env")
+		if err := godotenv.Load(path); err != nil {
 			return err
 		}
 	}
+
+	// Anything in the environment file may be a secret, except short values like ports and flags,
+	// which would be masked everywhere they appear
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		switch {
+		case logger.IsMaskable(v):
+			logger.AddSecret(v)
+		case strings.TrimSpace(v) != "" && logger.IsSecretVar(k):
+			logger.Warnf("%s is too short to be masked: its value will appear in logs and notifications.", k)
+		}
+	}
 	return nil
 }
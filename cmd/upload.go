@@ -30,6 +30,8 @@ var uploadCmd = &cobra.Command{
 		session := backup.NewSession(ctx,
 			backup.WithRemote(remoteDest),
 			backup.WithRemoteRoot(remoteRoot),
+			backup.WithJob(jobName),
+			backup.WithFaults(injectedFaults()),
 			backup.WithSimulation(simulate),
 			backup.WithInteractivity(!unattended),
 			backup.WithDebug(debug),
@@ -41,6 +43,7 @@ var uploadCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(uploadCmd)
+	addJobFlag(uploadCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -24,14 +25,35 @@ type BackupSession struct {
 	Machine  *config.Machine
 	Notifier *notify.Notifier
 	// Internals
-	context   context.Context
-	processed map[string]bool
-	mu        sync.Mutex
+	context    context.Context
+	runID      string
+	started    time.Time
+	snapshot   *Snapshot
+	simulated  DryRunStats
+	paths      []string
+	expansions []PatternExpansion
+	hooks      map[string][]*config.PathEntry
+	cmdEnv     []string
+	warnings   []BackupError
+	warnMu     sync.Mutex
+	graphs     []CmdGraph
+	faults     *FaultInjector
+	processed  map[string]bool
+	// The errors of each transferred path, whatever their source
+	pathErrs map[string][]BackupError
+	mu       sync.Mutex
 }
 
 type BackupOpts struct {
 	Remote     string
 	RemoteRoot string
+	Target     string
+	PathMaps   []PathMap
+	Snapshot   string
+	At         time.Time
+	Hostname   string
+	Job        string
+	Faults     *config.Faults
 	Language   string
 	Uploading  bool
 	Simulate   bool
@@ -83,6 +105,58 @@ func WithDownload() BackupOptFunc {
 	}
 }
 
+func WithTarget(target string) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		if target == "" {
+			return
+		}
+		if abs, err := filepath.Abs(target); err == nil {
+			target = abs
+		}
+		opts.Target = target
+	}
+}
+
+func WithPathMaps(maps ...PathMap) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.PathMaps = append(opts.PathMaps, maps...)
+	}
+}
+
+func WithSnapshot(id string) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.Snapshot = id
+	}
+}
+
+func WithPointInTime(at time.Time) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.At = at
+	}
+}
+
+// WithHostname makes the session act on the files of another machine.
+func WithHostname(hostname string) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.Hostname = hostname
+	}
+}
+
+// WithJob makes the session run one of the machine's jobs, instead of the machine's own paths and commands.
+// The job's remote and root are used unless others are given.
+func WithJob(name string) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.Job = name
+	}
+}
+
+// WithFaults injects errors in the session, replacing the faults configured for the machine.
+func WithFaults(faults *config.Faults) BackupOptFunc {
+	return func(opts *BackupOpts) {
+		opts.Faults = faults
+	}
+}
+
 func WithSimulation(simulate bool) BackupOptFunc {
 	return func(opts *BackupOpts) {
 		opts.Simulate = simulate
@@ -119,6 +193,61 @@ func NewSession(ctx context.Context, options ...BackupOptFunc) *BackupSession {
 		logger.Fatal(err.Error())
 	}
 
+	// Another machine's files may be inspected even if it isn't configured
+	if opts.Hostname != "" && opts.Hostname != machine.Hostname {
+		other, err := config.FindMachine(opts.Hostname)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		if other == nil {
+			logger.Debugf("Machine is not configured: %s", opts.Hostname)
+			other = &config.Machine{Hostname: opts.Hostname}
+		}
+		machine = other
+	}
+
+	// A job runs its own paths and commands, with the rest of the machine's configuration
+	var monitors *config.Monitors
+	if opts.Job != "" {
+		jobMachine, job, err := machine.ForJob(opts.Job)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		machine = jobMachine
+		monitors = job.Monitors
+		if opts.Remote == "" {
+			opts.Remote = job.Remote
+		}
+		if opts.RemoteRoot == "" {
+			opts.RemoteRoot = job.Root
+		}
+	}
+
+	// Faults given as an option take precedence over the configured ones.
+	// Configured faults only apply to simulations, so that they never keep a real backup from happening.
+	faults := machine.Faults
+	if faults != nil && !opts.Simulate && opts.Faults == nil {
+		logger.Warn("Faults are configured for this machine, but they are only injected in simulations (--simulate).")
+		faults = nil
+	}
+	if opts.Faults != nil {
+		faults = opts.Faults
+	}
+	injector, err := NewFaultInjector(faults)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if injector != nil {
+		logger.Warn("Fault injection is enabled: some paths and commands will fail on purpose.")
+	}
+
+	// Mask whatever the configured patterns match in logs and notifications
+	for _, pattern := range machine.Redact {
+		if err := logger.AddPattern(pattern); err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
+
 	// Load notifier parameters from environment
 	notifier, err := notify.NewNotifierFromEnv()
 	if err != nil {
@@ -126,11 +255,36 @@ func NewSession(ctx context.Context, options ...BackupOptFunc) *BackupSession {
 		logger.Error("The backup will still be performed, but notifications will not be sent.")
 	}
 
+	// A job only pings its own monitors, which would otherwise hear from every job of the machine on their own schedules
+	if opts.Job != "" {
+		ids := make(map[notify.HealthMonitors]string)
+		if monitors != nil {
+			ids[notify.HealthChecksIO] = os.ExpandEnv(monitors.Healthchecks)
+			ids[notify.BetterUptime] = os.ExpandEnv(monitors.BetterUptime)
+		}
+		for _, id := range ids {
+			logger.AddSecret(id)
+		}
+		if notifier == nil && monitors != nil {
+			notifier = notify.NewHeartbeatNotifier()
+		}
+		if notifier != nil {
+			notifier.UseMonitorIDs(ids)
+		}
+		if notifier == nil || len(notifier.HealthMonitors) == 0 {
+			logger.Warnf("Job '%s' has no monitors of its own: its runs send no heartbeats.", opts.Job)
+		}
+	}
+
+	started := time.Now()
 	return &BackupSession{
 		Opts:      opts,
 		Machine:   machine,
 		Notifier:  notifier,
 		context:   ctx,
+		runID:     newRunID(started),
+		started:   started,
+		faults:    injector,
 		processed: make(map[string]bool),
 	}
 }
@@ -141,10 +295,13 @@ func (session *BackupSession) Backup() {
 
 	numPaths := len(session.Machine.Paths)
 	numPreCmds := len(session.Machine.Pre)
-	numPostCmds := len(session.Machine.Post)
+	numPostCmds := len(session.Machine.Post) + len(session.Machine.OnSuccess) + len(session.Machine.OnFailure) + len(session.Machine.Always)
 
 	if numPaths == 0 && numPreCmds == 0 && numPostCmds == 0 {
 		logger.Error("Nothing to do. Please take a look at the configuration file.")
+		if session.Opts.Job == "" && len(session.Machine.Jobs) > 0 {
+			logger.Infof("This machine has jobs, which run with --job: %s", strings.Join(session.Machine.JobNames(), ", "))
+		}
 		return
 	}
 
@@ -160,6 +317,9 @@ func (session *BackupSession) Backup() {
 	} else {
 		sb.WriteString("Session ")
 	}
+	if session.Opts.Job != "" {
+		sb.WriteString(fmt.Sprintf("of job %s ", session.Opts.Job))
+	}
 	if session.Opts.Remote == "" {
 		sb.WriteString("(local)")
 	} else {
@@ -170,58 +330,205 @@ func (session *BackupSession) Backup() {
 	// Health
 	session.Heartbeat("start", false)
 
+	// Expand glob patterns, then check paths for overlaps and collisions.
+	// When downloading, patterns are matched against the remote instead.
+	paths := session.Machine.PathList()
+	var invalid []BackupError
+	if session.Opts.Uploading {
+		expanded, expansions, unmatched, malformed := expandPaths(paths)
+		invalid = malformed
+		session.expansions = expansions
+		session.warn(unmatched...)
+		paths = expanded
+	}
+
+	paths, conflicts := session.resolvePaths(paths)
+	if len(conflicts) > 0 && session.failOnConflicts() {
+		logger.Error("Configured paths are in conflict: nothing will be transferred.")
+		status := getAbortStatus("PathConflictsAbort", conflicts, session.Opts.Language)
+		session.NotifyStatus(status, "red_circle", "package")
+		session.Heartbeat("fail", true)
+		return
+	}
+	session.paths = paths
+	session.warn(conflicts...)
+	if session.Opts.Uploading {
+		session.hooks = pathHooks(session.Machine.Paths, session.expansions, paths)
+	}
+	numPaths = len(session.paths)
+
+	// Find the snapshot to restore, if one was requested
+	if !session.Opts.Uploading {
+		snapshot, err := session.selectSnapshot()
+		if err != nil {
+			logger.Errorf("Cannot restore the requested snapshot: %s", err)
+			status := getAbortStatus("SnapshotAbort", []BackupError{GenericError.Error("", err.Error())}, session.Opts.Language)
+			session.NotifyStatus(status, "red_circle", "package")
+			session.Heartbeat("fail", true)
+			return
+		}
+		if snapshot != nil {
+			logger.Infof("Restoring snapshot %s (%s)", snapshot.ID, snapshot.Time.Local().Format(time.DateTime))
+			session.snapshot = snapshot
+		}
+	}
+
 	// Execute pre commands
-	preErrCh := make(chan BackupError, numPreCmds)
+	preErrs := &ErrorList{}
+	preOutcome := cmdsCompleted
 	if numPreCmds > 0 {
 		logger.Info("Executing pre-transfer commands...")
-		executeCmds(preErrCh, session.Machine.Pre, session.Machine.Output)
+		preOutcome = session.executeCmds(preErrs, session.Machine.Pre, phasePre)
+	}
+
+	// Nothing gets transferred if a critical pre command failed, or one asked to skip the run
+	if preOutcome != cmdsCompleted {
+		session.stopBeforeTransfers(preErrs, preOutcome)
+		return
 	}
-	close(preErrCh)
 
-	// Spawn transfer goroutines
-	transferErrCh := make(chan BackupError, numPaths)
+	// Spawn transfer goroutines. Commands of single paths may fail too, and malformed patterns count as failed paths.
+	transferErrs := &ErrorList{}
+	for _, err := range invalid {
+		transferErrs.Add(err)
+	}
 	if numPaths > 0 {
 		logger.Debug("Spawning transfer routines...")
 		if session.Opts.Uploading {
-			for _, path := range session.Machine.Paths {
+			for _, path := range session.paths {
 				wg.Add(1)
-				go session.uploadPath(path, &wg, transferErrCh, session.Opts.Simulate)
+				go session.uploadPath(path, &wg, transferErrs, session.Opts.Simulate)
 			}
 		} else {
-			for _, path := range session.Machine.Paths {
+			for _, path := range session.paths {
 				wg.Add(1)
-				go session.downloadPath(path, &wg, transferErrCh, session.Opts.Simulate)
+				go session.downloadPath(path, &wg, transferErrs, session.Opts.Simulate)
 			}
 		}
 		// Sync goroutines
 		wg.Wait()
+
+		// Record what's on the remote after this run, then forget what's too old
+		if session.Opts.Uploading && !session.Opts.Simulate {
+			if err := session.writeSnapshot(); err != nil {
+				logger.Errorf("Error recording snapshot: %s", err)
+			} else if err := session.pruneSnapshots(); err != nil {
+				logger.Errorf("Error deleting old snapshots: %s", err)
+			}
+		}
+	}
+
+	success := succeeded(transferErrs, preErrs)
+	status := runFailed
+	if success {
+		status = runSucceeded
 	}
-	close(transferErrCh)
+	session.setRunEnv(status, session.getPathResults())
 
-	// Execute post commands
-	postErrCh := make(chan BackupError, numPostCmds)
-	if numPostCmds > 0 {
+	// Execute post commands, then those depending on the outcome of the transfers
+	postCmds := session.postCommands(success)
+	postErrs := &ErrorList{}
+	if len(postCmds) > 0 {
 		logger.Info("Executing post-transfer commands...")
-		executeCmds(postErrCh, session.Machine.Post, session.Machine.Output)
+		session.executeCmds(postErrs, postCmds, phasePost)
 	}
-	close(postErrCh)
 
 	// Notify status to user
 	logger.Info("BACKUP DONE!")
-	status, statusEmoji := getStatus(transferErrCh, preErrCh, postErrCh, session.Opts.Language)
-	session.NotifyStatus(status, statusEmoji, "package")
+	summary, statusEmoji := session.getStatus(transferErrs, preErrs, postErrs)
+	session.NotifyStatus(summary, statusEmoji, "package")
 
 	// Ping healthchecks
 	session.Heartbeat("", true)
 	logger.Infof("ALL DONE! Time taken: %v\n", time.Since(t0))
 }
 
+// warn records errors that don't make the run fail, to be reported as warnings.
+func (session *BackupSession) warn(errs ...BackupError) {
+	session.warnMu.Lock()
+	defer session.warnMu.Unlock()
+	for _, err := range errs {
+		err.Severity = SeverityWarning
+		session.warnings = append(session.warnings, err)
+	}
+}
+
+// postCommands returns the commands to execute once the transfers are done: the post commands,
+// then 'on_success' or 'on_failure' depending on the outcome of the run, then 'always'.
+func (session *BackupSession) postCommands(success bool) []config.Command {
+	outcomeCmds := session.Machine.OnFailure
+	if success {
+		outcomeCmds = session.Machine.OnSuccess
+	}
+	postCmds := make([]config.Command, 0, len(session.Machine.Post)+len(outcomeCmds)+len(session.Machine.Always))
+	postCmds = append(postCmds, session.Machine.Post...)
+	postCmds = append(postCmds, outcomeCmds...)
+	return append(postCmds, session.Machine.Always...)
+}
+
+// stopCommands returns the commands to execute when pre commands stopped the run before its transfers:
+// 'on_failure' if it was aborted, the post commands marked 'always', then 'always'.
+func (session *BackupSession) stopCommands(outcome cmdsOutcome) []config.Command {
+	var postCmds []config.Command
+	if outcome == cmdsAborted {
+		postCmds = append(postCmds, session.Machine.OnFailure...)
+	}
+	for _, command := range session.Machine.Post {
+		if command.Always {
+			postCmds = append(postCmds, command)
+		}
+	}
+	return append(postCmds, session.Machine.Always...)
+}
+
+// stopBeforeTransfers ends a run that its pre commands aborted or skipped.
+// Only the 'on_failure' commands of an aborted run, and the 'always' commands, are executed.
+func (session *BackupSession) stopBeforeTransfers(preErrs *ErrorList, outcome cmdsOutcome) {
+	runStatus := runSkipped
+	if outcome == cmdsAborted {
+		runStatus = runAborted
+	}
+	session.setRunEnv(runStatus, nil)
+
+	postCmds := session.stopCommands(outcome)
+	postErrs := &ErrorList{}
+	if len(postCmds) > 0 {
+		logger.Info("Executing post-transfer commands...")
+		session.executeCmds(postErrs, postCmds, phasePost)
+	}
+	errs := append(preErrs.Errors(), postErrs.Errors()...)
+
+	if outcome == cmdsSkipped {
+		logger.Info("A pre-transfer command asked to skip this run: nothing was transferred.")
+		status := getAbortStatus("PreSkipped", errs, session.Opts.Language) + session.getGraphStatus(session.Opts.Language)
+		session.NotifyStatus(status, "white_circle", "package")
+		session.Heartbeat("", true)
+		return
+	}
+
+	reasonID := "PreFailedAbort"
+	if session.context.Err() != nil {
+		logger.Error("The session was cancelled: nothing was transferred.")
+		reasonID = "SessionCancelled"
+	} else {
+		logger.Error("A critical pre-transfer command failed: nothing was transferred.")
+	}
+	status := getAbortStatus(reasonID, errs, session.Opts.Language) + session.getGraphStatus(session.Opts.Language)
+	session.NotifyStatus(status, "red_circle", "package")
+	session.Heartbeat("fail", true)
+}
+
 func (session *BackupSession) Heartbeat(endpoint string, withLog bool) {
 	if session.Notifier != nil {
-		if session.Opts.Simulate || !session.Opts.Unattended {
+		// Simulations don't ping the monitors, unless faults are injected to test them
+		if !session.Opts.Unattended {
 			logger.Debugf("Session is interactive: heartbeat will not be sent. %v", session.Notifier.HealthMonitors)
 			return
 		}
+		if session.Opts.Simulate && session.faults == nil {
+			logger.Debugf("Session is a simulation: heartbeat will not be sent. %v", session.Notifier.HealthMonitors)
+			return
+		}
 		resp, err := session.Notifier.SendHeartbeats(endpoint, withLog)
 		if err != nil {
 			logger.Errorf("Error sending heartbeat: %s", err)
@@ -233,16 +540,27 @@ func (session *BackupSession) Heartbeat(endpoint string, withLog bool) {
 }
 
 func (session *BackupSession) NotifyStatus(status string, statusTags ...string) {
-	if session.Notifier != nil {
+	if session.Notifier != nil && session.Notifier.CanSend() {
 		msgTitle := fmt.Sprintf(
 			"%s - %s",
 			strings.ToUpper(session.Machine.Hostname),
 			strings.ToTitle(session.Notifier.Topic),
 		)
-		msgTags := make([]string, 0, len(statusTags)+2)
+		msgTags := make([]string, 0, len(statusTags)+3)
 		msgTags = append(msgTags, statusTags...)
 		msgTags = append(msgTags, session.Machine.Hostname, session.Notifier.Topic)
 
+		// Each job is reported on its own
+		if session.Opts.Job != "" {
+			msgTitle = fmt.Sprintf(
+				"%s (%s) - %s",
+				strings.ToUpper(session.Machine.Hostname),
+				session.Opts.Job,
+				strings.ToTitle(session.Notifier.Topic),
+			)
+			msgTags = append(msgTags, session.Opts.Job)
+		}
+
 		resp, err := session.Notifier.Send(msgTitle, status, msgTags) //, notify.WithClickUrl(&url.URL{Host: session.Notifier.Host}))
 		if err != nil {
 			logger.Errorf("Error sending status notification: %s", err)
@@ -0,0 +1,461 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rc_fs "github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/diskusage"
+)
+
+// CmdFunc is a built-in command. It receives the whole command line, reports its errors to errs
+// and returns a description of what it did. ctx carries the directory and the variables of the commands, and
+// anything that waits must stop when it is done.
+type CmdFunc func(ctx context.Context, errs *ErrorList, command string) string
+
+var (
+	builtins   = make(map[string]CmdFunc)
+	builtinsMu sync.RWMutex
+)
+
+// RegisterBuiltin makes plain string commands starting with name run fn, instead of a program with that name.
+// Registering a name again replaces its command.
+func RegisterBuiltin(name string, fn CmdFunc) {
+	builtinsMu.Lock()
+	defer builtinsMu.Unlock()
+	builtins[name] = fn
+}
+
+// Builtin returns the built-in command with the given name.
+func Builtin(name string) (CmdFunc, bool) {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	fn, ok := builtins[name]
+	return fn, ok
+}
+
+// Builtins returns the names of the built-in commands.
+func Builtins() []string {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterBuiltin("sleep", cmdSleep)
+	RegisterBuiltin("cd", cmdCD)
+	RegisterBuiltin("export", cmdExport)
+	RegisterBuiltin("unset", cmdUnset)
+	RegisterBuiltin("pushd", cmdPushd)
+	RegisterBuiltin("popd", cmdPopd)
+	RegisterBuiltin("wait-for-file", cmdWaitForFile)
+	RegisterBuiltin("wait-for-port", cmdWaitForPort)
+	RegisterBuiltin("require-free-space", cmdRequireFreeSpace)
+	RegisterBuiltin("touch-marker", cmdTouchMarker)
+	RegisterBuiltin("fail-if-exists", cmdFailIfExists)
+}
+
+// How often waiting commands check again
+const waitInterval = 500 * time.Millisecond
+
+func cmdSleep(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) != 1 {
+		err := "invalid sleep syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	duration, err := parseWait(args[0])
+	if err != nil {
+		err := "invalid sleep duration"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	start := time.Now()
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+		return waitFailed(ctx, errs, command, start)
+	}
+	return "Slept for " + duration.String()
+}
+
+func cmdCD(ctx context.Context, errs *ErrorList, command string) string {
+	arg := strings.TrimSpace(strings.TrimPrefix(command, "cd"))
+	if arg == "" {
+		err := "invalid cd syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	absPath, err := findDir(ctx, arg)
+	if err != nil {
+		errs.Add(CmdInvalid.Error(command, err.Error()))
+		return err.Error()
+	}
+
+	commandOpts(ctx).setCWD(absPath)
+	return "Changed directory to: " + absPath
+}
+
+func cmdPushd(ctx context.Context, errs *ErrorList, command string) string {
+	arg := strings.TrimSpace(strings.TrimPrefix(command, "pushd"))
+	if arg == "" {
+		err := "invalid pushd syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	absPath, err := findDir(ctx, arg)
+	if err != nil {
+		errs.Add(CmdInvalid.Error(command, err.Error()))
+		return err.Error()
+	}
+
+	commandOpts(ctx).pushDir(absPath)
+	return "Changed directory to: " + absPath
+}
+
+func cmdPopd(ctx context.Context, errs *ErrorList, command string) string {
+	if len(builtinArgs(ctx, command)) != 0 {
+		err := "invalid popd syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	dir, ok := commandOpts(ctx).popDir()
+	if !ok {
+		err := "directory stack empty"
+		errs.Add(CmdFailed.Error(command, err))
+		return err
+	}
+	return "Changed directory to: " + dir
+}
+
+// findDir resolves a directory given to cd or pushd, which must exist.
+func findDir(ctx context.Context, arg string) (string, error) {
+	// Relative paths start from the current directory of the commands
+	cwd, env := commandOpts(ctx).get()
+	newDir := shellWord(arg, env)
+	if !filepath.IsAbs(newDir) {
+		newDir = filepath.Join(cwd, newDir)
+	}
+	absPath := filepath.Clean(newDir)
+
+	// Check if the directory exists
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
+		return "", errors.New("directory does not exist")
+	}
+	return absPath, nil
+}
+
+func cmdExport(ctx context.Context, errs *ErrorList, command string) string {
+	// Extract key and value from the command
+	k, v, found := strings.Cut(strings.TrimSpace(strings.TrimPrefix(command, "export")), "=")
+	if !found || k == "" || strings.ContainsAny(k, " \t") {
+		err := "invalid export syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+	opts := commandOpts(ctx)
+	_, env := opts.get()
+	v = shellWord(v, env)
+
+	addSecretVars([]string{k + "=" + v})
+	opts.addEnv(k + "=" + v)
+	return "Exported variable: " + k
+}
+
+func cmdUnset(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) == 0 {
+		err := "invalid unset syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	opts := commandOpts(ctx)
+	for _, k := range args {
+		opts.unsetEnv(k)
+	}
+	return "Unset variables: " + strings.Join(args, ", ")
+}
+
+// wait-for-file <path> [timeout]
+func cmdWaitForFile(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) < 1 || len(args) > 2 {
+		err := "invalid wait-for-file syntax: expected 'wait-for-file <path> [timeout]'"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	var timeout time.Duration
+	if len(args) == 2 {
+		d, err := parseWait(args[1])
+		if err != nil {
+			err := "invalid wait-for-file timeout"
+			errs.Add(CmdInvalid.Error(command, err))
+			return err
+		}
+		timeout = d
+	}
+
+	path := builtinPath(ctx, args[0])
+	start := time.Now()
+	err := waitUntil(ctx, timeout, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	if err != nil {
+		return waitFailed(ctx, errs, command, start)
+	}
+	return fmt.Sprintf("Found '%s' after %s", path, time.Since(start).Round(time.Millisecond))
+}
+
+// wait-for-port <host:port> <timeout>
+func cmdWaitForPort(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) != 2 {
+		err := "invalid wait-for-port syntax: expected 'wait-for-port <host:port> <timeout>'"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		err := "invalid wait-for-port address: expected host:port"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+	timeout, err := parseWait(args[1])
+	if err != nil {
+		err := "invalid wait-for-port timeout"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	start := time.Now()
+	err = waitUntil(ctx, timeout, func() bool {
+		dialer := net.Dialer{Timeout: time.Second}
+		conn, err := dialer.DialContext(ctx, "tcp", args[0])
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+	if err != nil {
+		return waitFailed(ctx, errs, command, start)
+	}
+	return fmt.Sprintf("Connected to '%s' after %s", args[0], time.Since(start).Round(time.Millisecond))
+}
+
+// require-free-space <path> <size>
+func cmdRequireFreeSpace(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) != 2 {
+		err := "invalid require-free-space syntax: expected 'require-free-space <path> <size>'"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+	var size rc_fs.SizeSuffix
+	if err := size.Set(args[1]); err != nil || size < 0 {
+		err := "invalid require-free-space size"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	path := builtinPath(ctx, args[0])
+	info, err := diskusage.New(path)
+	if err != nil {
+		errs.Add(CmdFailed.Error(command, err.Error()))
+		return err.Error()
+	}
+	available := rc_fs.SizeSuffix(info.Available)
+	if info.Available < uint64(size) {
+		err := fmt.Sprintf("only %s free on '%s', %s required", available, path, size)
+		errs.Add(CmdFailed.Error(command, err))
+		return err
+	}
+	return fmt.Sprintf("%s free on '%s'", available, path)
+}
+
+// touch-marker <path>
+func cmdTouchMarker(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) != 1 {
+		err := "invalid touch-marker syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	path := builtinPath(ctx, args[0])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		errs.Add(CmdFailed.Error(command, err.Error()))
+		return err.Error()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		errs.Add(CmdFailed.Error(command, err.Error()))
+		return err.Error()
+	}
+	f.Close()
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		errs.Add(CmdFailed.Error(command, err.Error()))
+		return err.Error()
+	}
+	return "Touched marker: " + path
+}
+
+// fail-if-exists <path>
+func cmdFailIfExists(ctx context.Context, errs *ErrorList, command string) string {
+	args := builtinArgs(ctx, command)
+	if len(args) != 1 {
+		err := "invalid fail-if-exists syntax"
+		errs.Add(CmdInvalid.Error(command, err))
+		return err
+	}
+
+	path := builtinPath(ctx, args[0])
+	var found []string
+	if isPattern(path) {
+		found, _ = filepath.Glob(path)
+	} else if _, err := os.Lstat(path); err == nil {
+		found = []string{path}
+	}
+	if len(found) > 0 {
+		err := fmt.Sprintf("'%s' exists", strings.Join(found, "', '"))
+		errs.Add(CmdFailed.Error(command, err))
+		return err
+	}
+	return fmt.Sprintf("'%s' does not exist", path)
+}
+
+// waitUntil checks a condition until it's true, the timeout expires or the context is done.
+func waitUntil(ctx context.Context, timeout time.Duration, check func() bool) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for {
+		if check() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitFailed reports a built-in command that stopped waiting, because of a timeout or because the session was cancelled.
+func waitFailed(ctx context.Context, errs *ErrorList, command string, start time.Time) string {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		err := "cancelled"
+		errs.Add(CmdFailed.Error(command, err))
+		return err
+	}
+	waited := time.Since(start).Round(time.Second)
+	errs.Add(CmdTimeout.Error(command, waited.String()))
+	return "timed out after " + waited.String()
+}
+
+// parseWait parses a duration, where plain numbers are seconds.
+func parseWait(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		return 0, fmt.Errorf("negative duration '%s'", s)
+	}
+	return d, err
+}
+
+// builtinPath resolves a path given to a built-in command from the current directory of the commands.
+func builtinPath(ctx context.Context, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	cwd, _ := commandOpts(ctx).get()
+	return filepath.Join(cwd, path)
+}
+
+// builtinArgs splits the arguments of a built-in command into words, as a POSIX shell would:
+// spaces within quotes don't split, and variables are expanded unless single-quoted.
+func builtinArgs(ctx context.Context, command string) []string {
+	_, rest, _ := strings.Cut(strings.TrimSpace(command), " ")
+	_, env := commandOpts(ctx).get()
+
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range rest {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, shellWord(word.String(), env))
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+		word.WriteRune(r)
+		inWord = true
+	}
+	if inWord {
+		args = append(args, shellWord(word.String(), env))
+	}
+	return args
+}
+
+// shellWord interprets a word as a POSIX shell would: single quotes keep it as it is,
+// while double quotes or no quotes at all let variables be expanded.
+func shellWord(s string, env []string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	quoted := len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
+	if quoted {
+		s = s[1 : len(s)-1]
+	}
+
+	// Escaped dollar signs are not expanded
+	unescape := strings.NewReplacer(`\"`, `"`, `\\`, `\`, "\\`", "`")
+	parts := strings.Split(s, `\$`)
+	for i, part := range parts {
+		if quoted {
+			part = unescape.Replace(part)
+		}
+		parts[i] = os.Expand(part, envLookup(env))
+	}
+	return strings.Join(parts, "$")
+}
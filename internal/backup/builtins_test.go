@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+func TestShellWord(t *testing.T) {
+	env := []string{"HOME=/home/me", "NAME=first", "NAME=last"}
+
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"plain", "plain"},
+		{"$HOME/bin", "/home/me/bin"},
+		{"${HOME}/bin", "/home/me/bin"},
+		{"$NAME", "last"},
+		{"$MISSING", ""},
+		{"'$HOME'", "$HOME"},
+		{`"$HOME dir"`, "/home/me dir"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`cost\$5`, "cost$5"},
+		{`"\$HOME is $HOME"`, "$HOME is /home/me"},
+		// Only quotes around the whole word are removed
+		{`a'b'`, `a'b'`},
+	}
+
+	for _, tt := range tests {
+		if got := shellWord(tt.word, env); got != tt.want {
+			t.Errorf("shellWord(%s) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestBuiltinArgs(t *testing.T) {
+	ctx := withCommandOpts(context.Background(), newCommandOpts(t.TempDir(), []string{"DIR=/srv/my data"}))
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"popd", nil},
+		{"sleep 5", []string{"5"}},
+		{"wait-for-file   /tmp/ready \t 30s ", []string{"/tmp/ready", "30s"}},
+		{"touch-marker $DIR/done", []string{"/srv/my data/done"}},
+		{`touch-marker "$DIR/done"`, []string{"/srv/my data/done"}},
+		{"fail-if-exists '/tmp/a b' \"c d\"", []string{"/tmp/a b", "c d"}},
+		{"unset A B", []string{"A", "B"}},
+	}
+
+	for _, tt := range tests {
+		if got := builtinArgs(ctx, tt.command); !slices.Equal(got, tt.want) {
+			t.Errorf("builtinArgs(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	var got []string
+	RegisterBuiltin("test-echo", func(ctx context.Context, errs *ErrorList, command string) string {
+		got = append(got, builtinArgs(ctx, command)...)
+		if len(got) > 2 {
+			errs.Add(CmdFailed.Error(command, "too many words"))
+		}
+		return "echoed"
+	})
+	t.Cleanup(func() {
+		builtinsMu.Lock()
+		delete(builtins, "test-echo")
+		builtinsMu.Unlock()
+	})
+
+	if !slices.Contains(Builtins(), "test-echo") || !slices.IsSorted(Builtins()) {
+		t.Errorf("Builtins() = %q, want a sorted list with 'test-echo'", Builtins())
+	}
+
+	// Plain commands starting with the name run it instead of a program
+	_, errs := runCmds(newTestSession(&config.Machine{}), phasePre, config.NewCommand("test-echo one two & test-echo three"))
+	if !slices.Equal(got, []string{"one", "two", "three"}) {
+		t.Errorf("the built-in received %q", got)
+	}
+	if len(errs) != 1 || errs[0].Source != "test-echo three" {
+		t.Errorf("errors = %+v, want the one reported by the built-in", errs)
+	}
+}
+
+func TestBuiltinsChangeTheContext(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	session := newTestSession(&config.Machine{})
+
+	_, errs := runCmds(session, phasePost,
+		config.NewCommand("cd "+dir+" & export GREETING=hello"),
+		config.NewCommand("pushd sub & touch-marker marker & popd"),
+		config.Command{Run: `echo "$GREETING from $PWD" > '` + out + `'`},
+		config.NewCommand("fail-if-exists sub/marker"),
+	)
+
+	data, _ := os.ReadFile(out)
+	if got, want := strings.TrimSpace(string(data)), "hello from "+dir; got != want {
+		t.Errorf("the command after the built-ins wrote %q, want %q", got, want)
+	}
+	if len(errs) != 1 || errs[0].Source != "fail-if-exists sub/marker" {
+		t.Errorf("errors = %+v, want fail-if-exists to find the marker", errs)
+	}
+}
+
+func TestWaitingBuiltins(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		command  string
+		wantCode BackupErrorCode
+	}{
+		{"timeout", context.Background(), "wait-for-file " + missing + " 1", CmdTimeout},
+		{"cancelled", ctx, "wait-for-file " + missing, CmdFailed},
+		{"invalid timeout", context.Background(), "wait-for-file " + missing + " soon", CmdInvalid},
+		{"invalid address", context.Background(), "wait-for-port localhost 1", CmdInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, _ := Builtin(strings.Fields(tt.command)[0])
+			errs := &ErrorList{}
+			fn(tt.ctx, errs, tt.command)
+
+			if got := errs.Errors(); len(got) != 1 || got[0].Code != tt.wantCode {
+				t.Errorf("%s reported %+v, want %v", tt.command, got, tt.wantCode)
+			}
+		})
+	}
+}
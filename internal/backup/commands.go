@@ -1,165 +1,545 @@
 package backup
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/0x07cf-dev/go-backup/internal/config"
 	"github.com/0x07cf-dev/go-backup/internal/logger"
 	"github.com/0x07cf-dev/go-backup/internal/utils"
 )
 
-type CmdFunc func(chan BackupError, string) string
-
-var CommandMap = map[string]CmdFunc{
-	"sleep":  cmdSleep,
-	"cd":     cmdCD,
-	"export": cmdExport,
-}
-
+// CommandOpts is the state the commands of a list leave to the following ones: the working directory,
+// the variables and the directories saved by pushd. Each list of commands starts from its own.
 type CommandOpts struct {
 	CWD string
 	Env []string
+	// Directories saved by pushd
+	dirs []string
+	// Commands may run in parallel
+	mu sync.RWMutex
+}
+
+type cmdOptsKey struct{}
+
+func newCommandOpts(cwd string, env []string) *CommandOpts {
+	return &CommandOpts{CWD: cwd, Env: env}
+}
+
+// withCommandOpts returns a context carrying the state of the commands, for the built-ins to use and change.
+func withCommandOpts(ctx context.Context, opts *CommandOpts) context.Context {
+	return context.WithValue(ctx, cmdOptsKey{}, opts)
 }
 
-var cmdContext CommandOpts
+// commandOpts returns the state of the commands carried by ctx. Without one, built-ins start
+// from the directory and the environment of the program.
+func commandOpts(ctx context.Context) *CommandOpts {
+	if opts, ok := ctx.Value(cmdOptsKey{}).(*CommandOpts); ok {
+		return opts
+	}
+	wd, _ := os.Getwd()
+	return newCommandOpts(wd, os.Environ())
+}
+
+// clone returns a copy of the state, which commands can change on their own.
+func (c *CommandOpts) clone() *CommandOpts {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &CommandOpts{CWD: c.CWD, Env: slices.Clone(c.Env), dirs: slices.Clone(c.dirs)}
+}
+
+// get returns the current working directory, and a copy of the environment.
+func (c *CommandOpts) get() (string, []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.CWD, append([]string{}, c.Env...)
+}
+
+// setState replaces the working directory and the environment, keeping the directories saved by pushd.
+func (c *CommandOpts) setState(cwd string, env []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CWD = cwd
+	c.Env = env
+}
+
+func (c *CommandOpts) setCWD(cwd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CWD = cwd
+}
+
+func (c *CommandOpts) addEnv(kv string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Env = append(c.Env, kv)
+}
+
+// unsetEnv removes every definition of a variable.
+func (c *CommandOpts) unsetEnv(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	env := c.Env[:0]
+	for _, kv := range c.Env {
+		if k, _, _ := strings.Cut(kv, "="); k != key {
+			env = append(env, kv)
+		}
+	}
+	c.Env = env
+}
+
+// pushDir saves the current directory before changing it.
+func (c *CommandOpts) pushDir(cwd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirs = append(c.dirs, c.CWD)
+	c.CWD = cwd
+}
+
+// popDir goes back to the last directory saved, returning false if there's none.
+func (c *CommandOpts) popDir() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.dirs) == 0 {
+		return "", false
+	}
+	c.CWD = c.dirs[len(c.dirs)-1]
+	c.dirs = c.dirs[:len(c.dirs)-1]
+	return c.CWD, true
+}
+
+// Commands run before or after the transfers
+const (
+	phasePre  = "pre"
+	phasePost = "post"
+)
 
-func executeCmds(errCh chan BackupError, commands []string, output bool) {
-	// Reset context
-	cmdContext.CWD, _ = os.Getwd()
-	cmdContext.Env = os.Environ()
-	logger.Debugf("Working directory: '%s'", cmdContext.CWD)
-	logger.Debugf("Environment: %v", cmdContext.Env)
+type cmdResult int
 
+const (
+	cmdSucceeded cmdResult = iota
+	cmdFailed
+	cmdSkipRun
+)
+
+// cmdsOutcome describes how a list of commands ended.
+type cmdsOutcome int
+
+const (
+	cmdsCompleted cmdsOutcome = iota
+	cmdsAborted               // A critical pre command failed
+	cmdsSkipped               // A pre command asked to skip the run
+)
+
+func (session *BackupSession) executeCmds(errs *ErrorList, commands []config.Command, phase string) cmdsOutcome {
+	// Every list of commands starts from the directory and the environment of the program
+	wd, _ := os.Getwd()
+	opts := newCommandOpts(wd, append(os.Environ(), session.cmdEnv...))
+	logger.Debugf("Working directory: '%s'", wd)
+	logger.Debugf("Environment: %v", logger.EnvNames(opts.Env))
+
+	// Commands that pick their own shell still run separately
+	shell := session.newShellSession(phase, opts)
+	if shell != nil {
+		defer shell.Close()
+	}
+
+	// Commands depending on others run as a graph
+	if isGraph(commands) {
+		return session.executeGraph(errs, opts, commands, phase, shell)
+	}
+
+	abortOnFailure := phase == phasePre && session.abortOnPreFailure()
+	delay := session.commandDelay()
 	for i, command := range commands {
 		ordinal := i + 1
-		subCommands := strings.Split(command, "&")
-		for _, subCommand := range subCommands {
-			subCommand = strings.TrimSpace(subCommand)
-			if subCommand == "" {
-				continue
+
+		// Nothing else runs once the session is cancelled
+		if err := session.context.Err(); err != nil {
+			logger.Warnf("Session cancelled: the remaining %d commands will not be executed", len(commands)-i)
+			if phase == phasePre {
+				return cmdsAborted
 			}
+			return cmdsCompleted
+		}
 
-			parts := strings.Split(subCommand, " ")
-			if len(parts) == 0 {
-				errCh <- CmdInvalid.Error(subCommand, "invalid command")
-				continue
+		// Each command counts once, however many errors it reports
+		cmdErrs := &ErrorList{}
+		var result cmdResult
+		if command.Plain() && shell == nil {
+			result = session.executeCmdLine(cmdErrs, opts, ordinal, command.Run, phase)
+		} else {
+			result = session.executeWithRetries(cmdErrs, opts, ordinal, command, phase, shell)
+		}
+		errs.Attempt(cmdErrs)
+
+		switch {
+		case result == cmdSkipRun:
+			logger.Infof("%d° asked to skip the run", ordinal)
+			return cmdsSkipped
+		case result == cmdFailed && phase == phasePre && (command.Critical || abortOnFailure):
+			logger.Errorf("%d° failed: the remaining commands will not be executed", ordinal)
+			return cmdsAborted
+		case result == cmdFailed && !command.ContinuesOnError():
+			if remaining := len(commands) - ordinal; remaining > 0 {
+				logger.Warnf("%d° failed: the remaining %d commands will not be executed", ordinal, remaining)
 			}
+			return cmdsCompleted
+		}
 
-			outTempl := "%d° (%s): '%s'"
-			errTempl := "%d° (%s): '%s'"
+		if delay > 0 && ordinal < len(commands) {
+			time.Sleep(delay)
+		}
+	}
+	return cmdsCompleted
+}
 
-			// Parse command and expand environment variables
-			systemCmd, err := utils.ParseCommand(subCommand)
-			if err != nil {
-				errCh <- CmdInvalid.Error(subCommand, "could not parse command")
-				continue
+// executeWithRetries runs a command until it succeeds or has no retries left.
+// Only the errors of the last attempt are reported.
+func (session *BackupSession) executeWithRetries(errs *ErrorList, opts *CommandOpts, ordinal int, command config.Command, phase string, shell *shellSession) cmdResult {
+	var retryDelay time.Duration
+	if command.RetryDelay != "" {
+		d, err := time.ParseDuration(command.RetryDelay)
+		if err != nil {
+			errs.Add(CmdInvalid.Error(command.String(), fmt.Sprintf("invalid retry_delay '%s'", command.RetryDelay)))
+			return cmdFailed
+		}
+		retryDelay = d
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptErrs := &ErrorList{}
+		var result cmdResult
+		if shell != nil && command.Shell == "" {
+			result = session.executeInShell(shell, attemptErrs, ordinal, command, phase)
+		} else {
+			result = session.executeCmd(attemptErrs, opts, ordinal, command, phase)
+		}
+
+		if result != cmdFailed || attempt >= command.Retries || session.context.Err() != nil {
+			for _, err := range attemptErrs.Errors() {
+				errs.Add(err)
 			}
+			return result
+		}
+
+		logger.Warnf("%d° failed: retrying in %s (%d/%d)", ordinal, retryDelay, attempt+1, command.Retries)
+		select {
+		case <-time.After(retryDelay):
+		case <-session.context.Done():
+		}
+	}
+}
+
+// executePathHooks runs the commands of a single path, reporting their errors as errors of that path.
+// It returns false if the path must not be transferred, because a critical command failed or one asked to skip it.
+func (session *BackupSession) executePathHooks(path string, commands []config.Command, phase string, errs *ErrorList) bool {
+	if len(commands) == 0 {
+		return true
+	}
+	logger.Infof("Executing %s commands of '%s'...", phase, path)
+
+	hookErrs := &ErrorList{}
+	outcome := session.executeCmds(hookErrs, commands, phase)
+	for _, err := range hookErrs.Errors() {
+		errs.Add(PathHookFailed.Error(path, fmt.Sprintf("%s '%s' - %s", phase, err.Source, err.Message)))
+	}
+
+	switch outcome {
+	case cmdsAborted:
+		logger.Errorf("A critical pre command of '%s' failed: it will not be transferred", path)
+		return false
+	case cmdsSkipped:
+		logger.Infof("A pre command of '%s' asked to skip it: it will not be transferred", path)
+		return false
+	}
+	return true
+}
+
+// executeCmdLine runs a command written as a plain string, split on '&' and spaces.
+func (session *BackupSession) executeCmdLine(errs *ErrorList, opts *CommandOpts, ordinal int, command string, phase string) cmdResult {
+	// Built-in commands report their own errors: any new error means the command failed
+	errsBefore := errs.Len()
+
+	timeout, err := session.commandTimeout(config.Command{})
+	if err != nil {
+		errs.Add(CmdInvalid.Error(command, err.Error()))
+		return cmdFailed
+	}
+
+	subCommands := strings.Split(command, "&")
+	for _, subCommand := range subCommands {
+		subCommand = strings.TrimSpace(subCommand)
+		if subCommand == "" {
+			continue
+		}
+
+		parts := strings.Split(subCommand, " ")
+		if len(parts) == 0 {
+			errs.Add(CmdInvalid.Error(subCommand, "invalid command"))
+			continue
+		}
 
-			// If command is in map, execute custom behaviour
-			// Otherwise, execute it on the system
-			baseCommand := parts[0]
-			if cmdFunc, ok := CommandMap[baseCommand]; ok {
-				output := cmdFunc(errCh, subCommand)
+		// Commands chosen to fail are not executed
+		if fault, ok := session.faults.forCommand(subCommand); ok {
+			errs.Add(fault)
+			continue
+		}
+
+		outTempl := "%d° (%s): '%s'"
+		errTempl := "%d° (%s): '%s'"
+
+		// If command is built-in, execute custom behaviour
+		// Otherwise, execute it on the system
+		ctx, cancel := session.commandContext(opts, timeout)
+		baseCommand := parts[0]
+		if cmdFunc, ok := Builtin(baseCommand); ok {
+			builtinErrs := errs.Len()
+			output := cmdFunc(ctx, errs, subCommand)
+			cancel()
+			if errs.Len() > builtinErrs {
+				logger.Errorf(errTempl, ordinal, subCommand, output)
+			} else {
 				logger.Infof(outTempl, ordinal, subCommand, output)
-				continue
 			}
+			continue
+		}
 
-			// Set command working directory
-			systemCmd.Dir = cmdContext.CWD
-			systemCmd.Env = cmdContext.Env
+		// Parse command and expand environment variables
+		systemCmd, err := utils.ParseCommand(ctx, subCommand)
+		if err != nil {
+			cancel()
+			errs.Add(CmdInvalid.Error(subCommand, "could not parse command"))
+			continue
+		}
 
-			// Pipe command output
-			stdoutBuf := bytes.Buffer{}
-			if output {
-				systemCmd.Stdout = &stdoutBuf
-			}
+		// Set command working directory
+		systemCmd.Dir, systemCmd.Env = opts.get()
 
-			// Errors will be displayed regardless of "output" config variable
-			stderrBuf := bytes.Buffer{}
-			systemCmd.Stderr = &stderrBuf
+		// Stream command output
+		stdout, stderr := session.outputWriters(phase, ordinal, session.Machine.ShowsOutput())
+		systemCmd.Stdout = stdout
+		systemCmd.Stderr = stderr
 
-			// Run command and display output
-			if err := systemCmd.Run(); err != nil {
-				logger.Errorf(errTempl, ordinal, subCommand)
-				logger.Error(stderrBuf.String())
-				errCh <- CmdFailed.Error(subCommand, stderrBuf.String())
+		// Run command and display output
+		err = systemCmd.Run()
+		stdout.Close()
+		stderr.Close()
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err != nil {
+			if timedOut {
+				logger.Errorf("%d° (%s): timed out after %s", ordinal, subCommand, timeout)
+				errs.Add(CmdTimeout.Error(subCommand, timeout.String()))
 				continue
-			} else if output {
-				logger.Infof(outTempl, ordinal, subCommand, stdoutBuf.String())
 			}
+			logger.Errorf(errTempl, ordinal, subCommand, err)
+			message := stderr.String()
+			if message == "" {
+				message = err.Error()
+			}
+			errs.Add(CmdFailed.Error(subCommand, message))
+			continue
 		}
-		time.Sleep(1 * time.Second)
 	}
+
+	if errs.Len() > errsBefore {
+		return cmdFailed
+	}
+	return cmdSucceeded
 }
 
-func cmdSleep(errCh chan BackupError, command string) string {
-	parts := strings.Split(command, " ")
-	if len(parts) < 2 {
-		err := "invalid sleep syntax"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+// executeCmd runs a command configured as an object. Nothing is split: the script goes whole to the shell,
+// or the program receives its args exactly as configured.
+func (session *BackupSession) executeCmd(errs *ErrorList, opts *CommandOpts, ordinal int, command config.Command, phase string) cmdResult {
+	name := command.String()
+	if command.Run == "" {
+		errs.Add(CmdInvalid.Error(name, "'run' is required"))
+		return cmdFailed
+	}
+
+	// Commands chosen to fail are not executed
+	if fault, ok := session.faults.forCommand(name); ok {
+		errs.Add(fault)
+		return cmdFailed
 	}
 
-	duration, err := strconv.Atoi(parts[1])
+	output := session.Machine.ShowsOutput()
+	if command.Output != nil {
+		output = *command.Output
+	}
+
+	// Additional variables may refer to the current ones
+	cwd, env := opts.get()
+	for _, kv := range command.Env {
+		if k, _, found := strings.Cut(kv, "="); !found || k == "" {
+			errs.Add(CmdInvalid.Error(name, fmt.Sprintf("invalid env entry '%s': expected KEY=value", kv)))
+			return cmdFailed
+		}
+		env = append(env, os.Expand(kv, envLookup(env)))
+	}
+	addSecretVars(env[len(env)-len(command.Env):])
+
+	timeout, err := session.commandTimeout(command)
 	if err != nil {
-		err := "invalid sleep duration"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+		errs.Add(CmdInvalid.Error(name, err.Error()))
+		return cmdFailed
 	}
+	ctx, cancel := session.commandContext(opts, timeout)
+	defer cancel()
 
-	time.Sleep(time.Duration(duration) * time.Second)
-	return "Sleeping for " + parts[1] + " seconds"
-}
+	// Programs run directly get their variables expanded here, scripts by their shell
+	var systemCmd *exec.Cmd
+	switch {
+	case command.Shell == config.ShellNone || (command.Shell == "" && len(command.Args) > 0):
+		args := make([]string, len(command.Args))
+		for i, arg := range command.Args {
+			args[i] = os.Expand(arg, envLookup(env))
+		}
+		systemCmd = exec.CommandContext(ctx, os.Expand(command.Run, envLookup(env)), args...)
+		utils.KillProcessGroup(systemCmd)
+	case len(command.Args) > 0:
+		errs.Add(CmdInvalid.Error(name, "args can't be passed to a shell: write them in 'run'"))
+		return cmdFailed
+	default:
+		systemCmd = utils.ShellCommand(ctx, command.Shell, command.Run)
+	}
 
-func cmdCD(errCh chan BackupError, command string) string {
-	parts := strings.Split(command, " ")
-	if len(parts) < 2 {
-		err := "invalid cd syntax"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+	systemCmd.Dir = cwd
+	if command.Dir != "" {
+		dir := os.Expand(command.Dir, envLookup(env))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cwd, dir)
+		}
+		systemCmd.Dir = dir
 	}
+	systemCmd.Env = env
 
-	newDir := parts[1]
-	absPath, err := filepath.Abs(newDir)
+	stdout, stderr := session.outputWriters(phase, ordinal, output)
+	systemCmd.Stdout = stdout
+	systemCmd.Stderr = stderr
+
+	err = systemCmd.Run()
+	stdout.Close()
+	stderr.Close()
 	if err != nil {
-		err := "error resolving absolute path for cd"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil && session.acceptsExitCode(ordinal, command, exitErr.ExitCode(), stderr.String()) {
+			return cmdSucceeded
+		}
+		if errors.As(err, &exitErr) && ctx.Err() == nil && asksToSkip(phase, command, exitErr.ExitCode()) {
+			return cmdSkipRun
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Errorf("%d° (%s): timed out after %s", ordinal, name, timeout)
+			errs.Add(CmdTimeout.Error(name, timeout.String()))
+			return cmdFailed
+		}
+		message := stderr.String()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			message = "cancelled"
+		} else if message == "" {
+			message = err.Error()
+		}
+		logger.Errorf("%d° (%s): '%s'", ordinal, name, err)
+		errs.Add(CmdFailed.Error(name, message))
+		return cmdFailed
+	}
+	return cmdSucceeded
+}
+
+// acceptsExitCode reports whether a command exiting with the given code succeeded.
+// Codes meaning success with a warning are reported as warnings, which don't make the run fail.
+func (session *BackupSession) acceptsExitCode(ordinal int, command config.Command, code int, stderr string) bool {
+	switch {
+	case command.IsOkCode(code):
+		return true
+	case command.IsWarnCode(code):
+		message := stderr
+		if message == "" {
+			message = fmt.Sprintf("exit status %d", code)
+		}
+		logger.Warnf("%d° (%s): exited with warning code %d", ordinal, command.String(), code)
+		session.warn(CmdFailed.Warning(command.String(), message))
+		return true
 	}
+	return false
+}
 
-	// Check if the directory exists
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		err := "directory does not exist"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+// commandTimeout returns how long a command may run, or 0 if there's no limit.
+func (session *BackupSession) commandTimeout(command config.Command) (time.Duration, error) {
+	timeout := command.Timeout
+	if timeout == "" {
+		timeout = session.Machine.CommandTimeout
+	}
+	if timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout '%s'", timeout)
 	}
+	return d, nil
+}
 
-	cmdContext.CWD = absPath
-	return "Changed directory to: " + absPath
+// commandContext returns the context of a command, carrying the state of the commands it runs with.
+// It ends with the session or when the timeout expires.
+func (session *BackupSession) commandContext(opts *CommandOpts, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := withCommandOpts(session.context, opts)
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
-func cmdExport(errCh chan BackupError, command string) string {
-	parts := strings.Split(command, " ")
-	if len(parts) < 2 {
-		err := "invalid export syntax"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+// commandDelay returns how long to wait between two commands.
+func (session *BackupSession) commandDelay() time.Duration {
+	if session.Machine.CommandDelay == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(session.Machine.CommandDelay)
+	if err != nil {
+		logger.Warnf("Invalid command_delay '%s': commands will run without delay", session.Machine.CommandDelay)
+		return 0
 	}
+	return d
+}
+
+// asksToSkip reports whether a pre command exited with one of the codes it's configured to skip the run with.
+// Commands written as plain strings have none, so they never skip it.
+func asksToSkip(phase string, command config.Command, code int) bool {
+	return phase == phasePre && command.IsSkipCode(code)
+}
 
-	// Extract key and value from the command
-	kv := strings.SplitN(parts[1], "=", 2)
-	if len(kv) != 2 {
-		err := "invalid export syntax"
-		errCh <- CmdInvalid.Error(command, err)
-		return err
+// abortOnPreFailure reports whether the machine is configured to abort when any pre command fails.
+func (session *BackupSession) abortOnPreFailure() bool {
+	switch session.Machine.PreFailure {
+	case "", config.PreFailureContinue:
+		return false
+	case config.PreFailureAbort:
+		return true
+	default:
+		logger.Warnf("Unknown value for pre_failure: '%s' (using '%s')", session.Machine.PreFailure, config.PreFailureContinue)
+		return false
 	}
-	k := kv[0]
-	v := kv[1]
+}
 
-	cmdContext.Env = append(cmdContext.Env, k+"="+v)
-	return "Exported variable: " + k + "=" + v
+// envLookup returns a function that finds variables in the given environment, the last occurrence winning.
+func envLookup(env []string) func(string) string {
+	return func(key string) string {
+		for i := len(env) - 1; i >= 0; i-- {
+			if k, v, found := strings.Cut(env[i], "="); found && k == key {
+				return v
+			}
+		}
+		return ""
+	}
 }
@@ -0,0 +1,264 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+// newTestSession returns a session that can run commands, without any remote.
+func newTestSession(m *config.Machine) *BackupSession {
+	return &BackupSession{
+		Opts:    &BackupOpts{},
+		Machine: m,
+		context: context.Background(),
+	}
+}
+
+// runCmds executes commands in a phase, returning how they ended and the errors they reported.
+func runCmds(session *BackupSession, phase string, commands ...config.Command) (cmdsOutcome, []BackupError) {
+	errs := &ErrorList{}
+	outcome := session.executeCmds(errs, commands, phase)
+	return outcome, errs.Errors()
+}
+
+// touch returns a command creating a file, and a function reporting whether it ran.
+func touch(t *testing.T) (config.Command, func() bool) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	ran := func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	}
+	return config.Command{Run: "touch '" + marker + "'"}, ran
+}
+
+func TestPreCommandSkipsRun(t *testing.T) {
+	next, ran := touch(t)
+	outcome, errs := runCmds(newTestSession(&config.Machine{}), phasePre, config.Command{Run: "exit 75", SkipCodes: []int{75}}, next)
+
+	if outcome != cmdsSkipped {
+		t.Errorf("outcome = %v, want %v", outcome, cmdsSkipped)
+	}
+	if len(errs) > 0 {
+		t.Errorf("skipping reported errors: %+v", errs)
+	}
+	if ran() {
+		t.Error("a command ran after the run was skipped")
+	}
+}
+
+func TestSkipCodesFail(t *testing.T) {
+	tests := []struct {
+		name    string
+		phase   string
+		command config.Command
+	}{
+		{"post command", phasePost, config.Command{Run: "exit 75", SkipCodes: []int{75}}},
+		{"other code", phasePre, config.Command{Run: "exit 75", SkipCodes: []int{3}}},
+		{"no skip codes", phasePre, config.NewCommand("sh -c 'exit 75'")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcome, errs := runCmds(newTestSession(&config.Machine{}), tt.phase, tt.command)
+			if outcome != cmdsCompleted {
+				t.Errorf("outcome = %v, want %v", outcome, cmdsCompleted)
+			}
+			if len(errs) != 1 || errs[0].Code != CmdFailed {
+				t.Errorf("errors = %+v, want a single %v", errs, CmdFailed)
+			}
+		})
+	}
+}
+
+func TestPreCommandsAbort(t *testing.T) {
+	tests := []struct {
+		name       string
+		preFailure string
+		failing    config.Command
+		want       cmdsOutcome
+	}{
+		{"critical command", "", config.Command{Run: "exit 1", Critical: true}, cmdsAborted},
+		{"pre_failure abort", config.PreFailureAbort, config.NewCommand("false"), cmdsAborted},
+		{"pre_failure continue", config.PreFailureContinue, config.Command{Run: "exit 1"}, cmdsCompleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, ran := touch(t)
+			session := newTestSession(&config.Machine{PreFailure: tt.preFailure})
+			outcome, errs := runCmds(session, phasePre, tt.failing, next)
+
+			if outcome != tt.want {
+				t.Errorf("outcome = %v, want %v", outcome, tt.want)
+			}
+			if len(errs) != 1 {
+				t.Errorf("errors = %+v, want the failure only", errs)
+			}
+			if aborted := tt.want == cmdsAborted; ran() == aborted {
+				t.Errorf("next command ran: %v, want %v", ran(), !aborted)
+			}
+		})
+	}
+}
+
+func TestPostHooks(t *testing.T) {
+	session := newTestSession(&config.Machine{
+		Post:      []config.Command{config.NewCommand("post"), {Run: "notify", Always: true}},
+		OnSuccess: []config.Command{config.NewCommand("success")},
+		OnFailure: []config.Command{config.NewCommand("failure")},
+		Always:    []config.Command{config.NewCommand("always")},
+	})
+
+	tests := []struct {
+		name string
+		got  []config.Command
+		want []string
+	}{
+		{"succeeded", session.postCommands(true), []string{"post", "notify", "success", "always"}},
+		{"failed", session.postCommands(false), []string{"post", "notify", "failure", "always"}},
+		{"aborted", session.stopCommands(cmdsAborted), []string{"failure", "notify", "always"}},
+		{"skipped", session.stopCommands(cmdsSkipped), []string{"notify", "always"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, c := range tt.got {
+			got = append(got, c.Run)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: commands = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		machine  string
+		command  config.Command
+		wantCode BackupErrorCode
+	}{
+		{"machine timeout", "200ms", config.Command{Run: "sleep 10"}, CmdTimeout},
+		{"command timeout first", "1h", config.Command{Run: "sleep 10", Timeout: "200ms"}, CmdTimeout},
+		{"plain command", "200ms", config.NewCommand("tail -f /dev/null"), CmdTimeout},
+		{"invalid timeout", "", config.Command{Run: "true", Timeout: "soon"}, CmdInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSession(&config.Machine{CommandTimeout: tt.machine})
+
+			start := time.Now()
+			_, errs := runCmds(session, phasePost, tt.command)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("the command ran for %s", elapsed)
+			}
+			if len(errs) != 1 || errs[0].Code != tt.wantCode {
+				t.Errorf("errors = %+v, want a single %v", errs, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestTimeoutKillsChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are POSIX only")
+	}
+	after := filepath.Join(t.TempDir(), "after")
+	command := config.Command{Run: "(sleep 1; touch '" + after + "') & wait", Timeout: "100ms"}
+
+	runCmds(newTestSession(&config.Machine{}), phasePost, command)
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(after); err == nil {
+		t.Error("a process started by the command outlived its timeout")
+	}
+}
+
+func TestCommandRetries(t *testing.T) {
+	// Fails until it has been attempted three times
+	counter := filepath.Join(t.TempDir(), "attempts")
+	script := fmt.Sprintf(`n=$(cat '%[1]s' 2>/dev/null || echo 0); n=$((n+1)); echo $n > '%[1]s'; echo "attempt $n" >&2; [ $n -ge 3 ]`, counter)
+	attempts := func() string {
+		data, _ := os.ReadFile(counter)
+		os.Remove(counter)
+		return strings.TrimSpace(string(data))
+	}
+	session := newTestSession(&config.Machine{})
+
+	outcome, errs := runCmds(session, phasePre, config.Command{Run: script, Retries: 2, Critical: true})
+	if outcome != cmdsCompleted || len(errs) > 0 || attempts() != "3" {
+		t.Errorf("with 2 retries: outcome %v, errors %+v, want success on the third attempt", outcome, errs)
+	}
+
+	outcome, errs = runCmds(session, phasePre, config.Command{Run: script, Retries: 1, RetryDelay: "10ms", Critical: true})
+	if outcome != cmdsAborted || attempts() != "2" {
+		t.Errorf("with 1 retry: outcome %v, want %v after 2 attempts", outcome, cmdsAborted)
+	}
+	// Only the last attempt is reported
+	if len(errs) != 1 || strings.TrimSpace(errs[0].Message) != "attempt 2" {
+		t.Errorf("errors = %+v, want the one of the last attempt", errs)
+	}
+
+	_, errs = runCmds(session, phasePost, config.Command{Run: "true", Retries: 1, RetryDelay: "a bit"})
+	if len(errs) != 1 || errs[0].Code != CmdInvalid {
+		t.Errorf("errors = %+v, want a single %v", errs, CmdInvalid)
+	}
+}
+
+func TestCancelledSessionRunsNothing(t *testing.T) {
+	session := newTestSession(&config.Machine{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	session.context = ctx
+
+	next, ran := touch(t)
+	if outcome, _ := runCmds(session, phasePre, next); outcome != cmdsAborted {
+		t.Errorf("pre outcome = %v, want %v", outcome, cmdsAborted)
+	}
+	if outcome, _ := runCmds(session, phasePost, next); outcome != cmdsCompleted {
+		t.Errorf("post outcome = %v, want %v", outcome, cmdsCompleted)
+	}
+	if ran() {
+		t.Error("a command ran in a cancelled session")
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      config.Command
+		wantErrs     int
+		wantWarnings int
+	}{
+		{"ok code", config.Command{Run: "exit 1", OkCodes: []int{1}}, 0, 0},
+		{"warning code", config.Command{Run: "echo 'some files vanished' >&2; exit 24", WarnCodes: []int{24}}, 0, 1},
+		{"other code", config.Command{Run: "exit 2", OkCodes: []int{1}, WarnCodes: []int{24}}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSession(&config.Machine{})
+			_, errs := runCmds(session, phasePost, tt.command)
+			if len(errs) != tt.wantErrs {
+				t.Errorf("errors = %+v, want %d", errs, tt.wantErrs)
+			}
+			if len(session.warnings) != tt.wantWarnings {
+				t.Fatalf("warnings = %+v, want %d", session.warnings, tt.wantWarnings)
+			}
+			for _, w := range session.warnings {
+				if w.Severity != SeverityWarning || w.Message != "some files vanished" {
+					t.Errorf("warning = %+v, want the command's stderr as a warning", w)
+				}
+			}
+		})
+	}
+}
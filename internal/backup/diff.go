@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+	rc_ops "github.com/rclone/rclone/fs/operations"
+	rc_walk "github.com/rclone/rclone/fs/walk"
+)
+
+type DiffKind string
+
+const (
+	DiffNew      DiffKind = "new"
+	DiffModified DiffKind = "modified"
+	DiffDeleted  DiffKind = "deleted"
+)
+
+// DiffEntry is a file that differs between the machine and the remote.
+type DiffEntry struct {
+	Kind DiffKind `json:"kind"`
+	Path string   `json:"path"`
+	Size int64    `json:"size"`
+}
+
+// Diff compares every configured path to its copy on the remote, without transferring anything.
+// New and modified files are those the next upload would transfer; deleted files only exist on the remote.
+// Paths are resolved as for an upload: unmatched patterns and conflicts are only logged, malformed patterns are errors.
+func (session *BackupSession) Diff() ([]DiffEntry, []BackupError) {
+	paths, _, _, invalid := expandPaths(session.Machine.PathList())
+	paths, _ = session.resolvePaths(paths)
+
+	var diff []DiffEntry
+	errs := &ErrorList{}
+	for _, err := range invalid {
+		errs.Add(err)
+	}
+	for _, path := range paths {
+		diff = append(diff, session.diffPath(path, errs)...)
+	}
+	return diff, errs.Errors()
+}
+
+// diffPath compares a configured path with the remote the same way uploadPath transfers it.
+func (session *BackupSession) diffPath(path string, errs *ErrorList) []DiffEntry {
+	currFile, err := os.Stat(path)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return nil
+	}
+
+	// Single files are compared within their parent directory
+	srcRoot, name := absPath, ""
+	if !currFile.IsDir() {
+		srcRoot, name = filepath.Dir(absPath), currFile.Name()
+	}
+	remotePath, err := session.getRemotePath(srcRoot)
+	if err != nil {
+		errs.Add(GenericError.Error(path, err.Error()))
+		return nil
+	}
+
+	srcFs, err := rc_fs.NewFs(session.context, srcRoot)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return nil
+	}
+	destFs, err := rc_fs.NewFs(session.context, remotePath)
+	if err != nil {
+		errs.Add(GenericError.Error(path, err.Error()))
+		return nil
+	}
+
+	src, err := session.listObjects(srcFs, name)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return nil
+	}
+	dest, err := session.listObjects(destFs, name)
+	if err != nil {
+		errs.Add(GenericError.Error(path, err.Error()))
+		return nil
+	}
+
+	// Go-backup's own files aren't missing from the path
+	if meta, ok := session.metaRel(remotePath); ok {
+		for remote := range dest {
+			if remote == meta || strings.HasPrefix(remote, meta+"/") {
+				delete(dest, remote)
+			}
+		}
+	}
+
+	var entries []DiffEntry
+	for remote, srcObj := range src {
+		local := filepath.Join(srcRoot, filepath.FromSlash(remote))
+		destObj, ok := dest[remote]
+		if !ok {
+			entries = append(entries, DiffEntry{Kind: DiffNew, Path: local, Size: srcObj.Size()})
+		} else if rc_ops.NeedTransfer(session.context, destObj, srcObj) {
+			entries = append(entries, DiffEntry{Kind: DiffModified, Path: local, Size: srcObj.Size()})
+		}
+	}
+	for remote, destObj := range dest {
+		if _, ok := src[remote]; !ok {
+			local := filepath.Join(srcRoot, filepath.FromSlash(remote))
+			entries = append(entries, DiffEntry{Kind: DiffDeleted, Path: local, Size: destObj.Size()})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	logger.Debugf("Compared '%s' ---> '%s': %d differences", path, remotePath, len(entries))
+	return entries
+}
+
+// listObjects returns the objects in f, or just the named one, keyed by their path.
+func (session *BackupSession) listObjects(f rc_fs.Fs, name string) (map[string]rc_fs.Object, error) {
+	objects := make(map[string]rc_fs.Object)
+	if name != "" {
+		obj, err := f.NewObject(session.context, name)
+		if errors.Is(err, rc_fs.ErrorObjectNotFound) || errors.Is(err, rc_fs.ErrorDirNotFound) {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+		objects[obj.Remote()] = obj
+		return objects, nil
+	}
+
+	if _, err := f.List(session.context, ""); errors.Is(err, rc_fs.ErrorDirNotFound) {
+		return objects, nil
+	}
+	err := rc_walk.ListR(session.context, f, "", false, -1, rc_walk.ListObjects, func(entries rc_fs.DirEntries) error {
+		entries.ForObject(func(obj rc_fs.Object) {
+			objects[obj.Remote()] = obj
+		})
+		return nil
+	})
+	return objects, err
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+	rc_accounting "github.com/rclone/rclone/fs/accounting"
+)
+
+// DryRunStats counts what a simulated session would have transferred.
+type DryRunStats struct {
+	Files int
+	Bytes int64
+}
+
+// withDryRun returns a context in which rclone only pretends to transfer,
+// keeping the statistics of the given path separate from the others.
+func withDryRun(ctx context.Context, path string) context.Context {
+	// Keep track of every transfer, so that they can all be listed
+	rc_accounting.MaxCompletedTransfers = -1
+
+	ctx, ci := rc_fs.AddConfig(ctx)
+	ci.DryRun = true
+	return rc_accounting.WithStatsGroup(ctx, "simulate:"+path)
+}
+
+// reportDryRun logs the files a simulated transfer would have copied,
+// and reports the errors it would have encountered.
+func (session *BackupSession) reportDryRun(ctx context.Context, path string, srcRoot string, remotePath string, err error, errs *ErrorList) {
+	group, _ := rc_accounting.StatsGroupFromContext(ctx)
+	stats := rc_accounting.StatsGroup(ctx, group)
+
+	files, failed := 0, 0
+	var bytes int64
+	for _, tr := range stats.Transferred() {
+		if tr.Checked {
+			continue
+		}
+		name := filepath.Join(srcRoot, filepath.FromSlash(tr.Name))
+		if tr.Error != nil {
+			logger.Errorf("Would fail to upload: '%s': %s", name, tr.Error)
+			errs.Add(UploadError.Error(name, tr.Error.Error()))
+			failed++
+			continue
+		}
+		logger.Infof("Would upload: '%s' (%s)", name, rc_fs.SizeSuffix(tr.Size))
+		files++
+		bytes += tr.Size
+	}
+	logger.Infof("Would upload %d files (%s): '%s' ---> '%s'", files, rc_fs.SizeSuffix(bytes), path, remotePath)
+
+	session.simulated.Files += files
+	session.simulated.Bytes += bytes
+
+	// Errors that didn't concern a single file, such as unreadable directories
+	if err != nil && failed == 0 {
+		errs.Add(UploadError.Error(path, err.Error()))
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+)
+
+// Outcomes of a run, as exported to post commands
+const (
+	runSucceeded = "success"
+	runFailed    = "failure"
+	runAborted   = "aborted"
+	runSkipped   = "skipped"
+)
+
+// PathResult is the outcome of the transfer of a single path.
+type PathResult struct {
+	Path   string        `json:"path"`
+	Status string        `json:"status"`
+	Errors []BackupError `json:"errors,omitempty"`
+}
+
+// getPathResults returns the outcome of the transfer of each path.
+func (session *BackupSession) getPathResults() []PathResult {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	results := make([]PathResult, 0, len(session.paths))
+	for _, path := range session.paths {
+		result := PathResult{Path: path, Status: runSucceeded, Errors: session.pathErrs[path]}
+		if len(result.Errors) > 0 {
+			result.Status = runFailed
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// addSecretVars masks the values of the variables that hold secrets, warning about those too short to be masked.
+func addSecretVars(env []string) {
+	for _, name := range logger.AddSecretVars(env) {
+		logger.Warnf("%s is too short to be masked: its value will appear in logs and notifications.", name)
+	}
+}
+
+// setRunEnv describes the run so far to the post commands, through their environment.
+func (session *BackupSession) setRunEnv(status string, results []PathResult) {
+	if results == nil {
+		results = []PathResult{}
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Status != runSucceeded {
+			failed++
+		}
+	}
+
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		logger.Errorf("Error encoding path results: %s", err)
+		resultsJSON = []byte("[]")
+	}
+
+	session.cmdEnv = []string{
+		"GOBACKUP_STATUS=" + status,
+		"GOBACKUP_FAILED_TRANSFERS=" + strconv.Itoa(failed),
+		"GOBACKUP_REMOTE=" + session.Opts.Remote,
+		"GOBACKUP_REMOTE_ROOT=" + session.Opts.RemoteRoot,
+		"GOBACKUP_HOSTNAME=" + session.Machine.Hostname,
+		"GOBACKUP_JOB=" + session.Opts.Job,
+		"GOBACKUP_RUN_ID=" + session.runID,
+		"GOBACKUP_LOG=" + logger.LogPath,
+		"GOBACKUP_RESULTS=" + string(resultsJSON),
+	}
+}
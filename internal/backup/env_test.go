@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+func TestPathResults(t *testing.T) {
+	session := newTestSession(&config.Machine{})
+	session.paths = []string{"/srv/www", "/srv/www-old", "/var/log/*.log", "/var/log/*.txt"}
+
+	// Errors of files under a path, and of the fixed part of a pattern, belong to the path they were transferred for
+	fileErr := UploadError.Error("/srv/www/index.html", "permission denied")
+	patternErr := DownloadError.Error("/var/log", "directory not found")
+	transfers := &ErrorList{}
+	for path, errs := range map[string][]BackupError{
+		"/srv/www":       {fileErr},
+		"/srv/www-old":   nil,
+		"/var/log/*.log": {patternErr},
+		"/var/log/*.txt": nil,
+	} {
+		list := &ErrorList{}
+		for _, err := range errs {
+			list.Add(err)
+		}
+		session.recordTransfer(path, list, transfers)
+	}
+
+	want := []PathResult{
+		{Path: "/srv/www", Status: runFailed, Errors: []BackupError{fileErr}},
+		{Path: "/srv/www-old", Status: runSucceeded},
+		{Path: "/var/log/*.log", Status: runFailed, Errors: []BackupError{patternErr}},
+		{Path: "/var/log/*.txt", Status: runSucceeded},
+	}
+	if got := session.getPathResults(); !reflect.DeepEqual(got, want) {
+		t.Errorf("getPathResults() = %+v, want %+v", got, want)
+	}
+	if failed, attempts := transfers.counts(); failed != 2 || attempts != 4 {
+		t.Errorf("%d of %d transfers failed, want 2 of 4", failed, attempts)
+	}
+}
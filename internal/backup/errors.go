@@ -1,20 +1,46 @@
 package backup
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/0x07cf-dev/go-backup/internal/lang"
 	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
 )
 
 type BackupErrorCode int8
 
 type BackupError struct {
-	Code    BackupErrorCode
-	Source  string
-	Message string
+	Code     BackupErrorCode `json:"code"`
+	Severity Severity        `json:"severity"`
+	Source   string          `json:"source"`
+	Message  string          `json:"message"`
+}
+
+// Severity tells whether an error makes the run fail, or is only a warning.
+type Severity int8
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+var severityNames = []string{
+	"error",
+	"warning",
+}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
 }
 
 const (
@@ -24,6 +50,12 @@ const (
 	PathError
 	UploadError
 	DownloadError
+	PathDuplicate
+	PathNested
+	PathCollision
+	PatternNoMatch
+	PathHookFailed
+	CmdTimeout
 )
 
 var backupErrIDs = []string{
@@ -33,12 +65,52 @@ var backupErrIDs = []string{
 	"ErrorPath",
 	"ErrorUpload",
 	"ErrorDownload",
+	"ErrorPathDuplicate",
+	"ErrorPathNested",
+	"ErrorPathCollision",
+	"ErrorPatternNoMatch",
+	"ErrorPathHook",
+	"ErrorCmdTimeout",
+}
+
+// Names used to refer to error codes in configurations
+var backupErrNames = []string{
+	"GenericError",
+	"CmdInvalid",
+	"CmdFailed",
+	"PathError",
+	"UploadError",
+	"DownloadError",
+	"PathDuplicate",
+	"PathNested",
+	"PathCollision",
+	"PatternNoMatch",
+	"PathHookFailed",
+	"CmdTimeout",
 }
 
 func (e BackupErrorCode) ID() string {
 	return backupErrIDs[e]
 }
 
+func (e BackupErrorCode) String() string {
+	return backupErrNames[e]
+}
+
+// ParseBackupErrorCode returns the error code with the given name.
+func ParseBackupErrorCode(name string) (BackupErrorCode, error) {
+	for i, n := range backupErrNames {
+		if strings.EqualFold(n, name) || strings.EqualFold(backupErrIDs[i], name) {
+			return BackupErrorCode(i), nil
+		}
+	}
+	return GenericError, fmt.Errorf("unknown error code '%s' (expected one of: %s)", name, strings.Join(backupErrNames, ", "))
+}
+
+func (e BackupErrorCode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.String())
+}
+
 func (e BackupErrorCode) Error(source string, message string) BackupError {
 	return BackupError{
 		Code:    e,
@@ -47,6 +119,13 @@ func (e BackupErrorCode) Error(source string, message string) BackupError {
 	}
 }
 
+// Warning returns an error that is only a warning, which never makes the run fail.
+func (e BackupErrorCode) Warning(source string, message string) BackupError {
+	err := e.Error(source, message)
+	err.Severity = SeverityWarning
+	return err
+}
+
 func (e BackupError) Localize(langs ...string) string {
 	template := map[string]string{
 		"Source":  e.Source,
@@ -55,35 +134,113 @@ func (e BackupError) Localize(langs ...string) string {
 	return lang.GetTranslator().LocalizeTemplate(e.Code.ID(), template, langs...)
 }
 
-func getStatus(errCh chan BackupError, preErrCh chan BackupError, postErrCh chan BackupError, langs ...string) (string, string) {
+// getAbortStatus describes a session that was stopped before any transfer took place.
+func getAbortStatus(reasonID string, errs []BackupError, langs ...string) string {
 	var status strings.Builder
-	statusEmoji := "green_circle"
+	status.WriteString(lang.GetTranslator().Localize(reasonID, langs...) + "\n")
 
-	// Check all errors
-	var transferErrors []BackupError
-	var preErrors []BackupError
-	var postErrors []BackupError
+	templ := "%d° | %s\n"
+	for i, err := range errs {
+		status.WriteString(fmt.Sprintf(templ, i+1, err.Localize(langs...)))
+	}
+	return status.String()
+}
+
+// ErrorList collects the errors of one part of a run, like its transfers or its pre commands.
+// It's safe for concurrent use and, unlike a channel, never blocks however many errors are added.
+// It also counts what was attempted, so that fail rates don't depend on how many errors each attempt reports.
+type ErrorList struct {
+	mu       sync.Mutex
+	errs     []BackupError
+	attempts int
+	failures int
+}
 
-	for err := range errCh {
-		transferErrors = append(transferErrors, err)
+// Add records an error, which counts as an attempt that failed.
+func (l *ErrorList) Add(err BackupError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err)
+	l.attempts++
+	l.failures++
+}
+
+// Attempt records a transfer or a command along with the errors it reported:
+// however many they are, it counts as a single attempt, which failed if there are any.
+func (l *ErrorList) Attempt(errs *ErrorList) {
+	reported := errs.Errors()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attempts++
+	if len(reported) > 0 {
+		l.errs = append(l.errs, reported...)
+		l.failures++
 	}
-	for err := range preErrCh {
-		preErrors = append(preErrors, err)
+}
+
+// Len returns the number of errors.
+func (l *ErrorList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.errs)
+}
+
+// Errors returns a copy of the errors, in the order they were added.
+func (l *ErrorList) Errors() []BackupError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]BackupError(nil), l.errs...)
+}
+
+// counts returns how many attempts failed, out of how many were made.
+func (l *ErrorList) counts() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failures, l.attempts
+}
+
+// succeeded reports whether no error was added to any of the lists, which makes a run successful.
+func succeeded(lists ...*ErrorList) bool {
+	for _, l := range lists {
+		if l.Len() > 0 {
+			return false
+		}
 	}
-	for err := range postErrCh {
-		postErrors = append(postErrors, err)
+	return true
+}
+
+// failRate returns the percentage of attempts that failed.
+func failRate(failures int, attempts int) int {
+	if attempts == 0 {
+		return 0
 	}
+	return int(float32(failures) / float32(attempts) * 100)
+}
+
+func (session *BackupSession) getStatus(transferErrs *ErrorList, preErrs *ErrorList, postErrs *ErrorList) (string, string) {
+	langs := []string{session.Opts.Language}
+	success := succeeded(transferErrs, preErrs, postErrs)
+	session.warnMu.Lock()
+	warnings := session.warnings
+	session.warnMu.Unlock()
+	var status strings.Builder
+	statusEmoji := "green_circle"
+
+	// Check all errors
+	transferErrors := transferErrs.Errors()
+	preErrors := preErrs.Errors()
+	postErrors := postErrs.Errors()
 
-	failedTransfers := len(transferErrors)
-	failedPre := len(preErrors)
-	failedPost := len(postErrors)
+	failedTransfers, transfers := transferErrs.counts()
+	failedPre, pres := preErrs.counts()
+	failedPost, posts := postErrs.counts()
 
-	if failedTransfers == 0 && failedPre == 0 && failedPost == 0 {
+	if success {
 		status.WriteString(lang.GetTranslator().Localize("Success", langs...))
 	} else {
-		possibleFails := cap(errCh) + cap(preErrCh) + cap(postErrCh)
+		possibleFails := transfers + pres + posts
 		totalFails := failedTransfers + failedPre + failedPost
-		totalFailRate := int(float32(totalFails) / float32(possibleFails) * 100)
+		totalFailRate := failRate(totalFails, possibleFails)
 		logger.Debugf("Failures: %d/%d (%d%%)", totalFails, possibleFails, totalFailRate)
 
 		// Not a perfect run
@@ -100,8 +257,8 @@ func getStatus(errCh chan BackupError, preErrCh chan BackupError, postErrCh chan
 		// Append upload errors
 		templ := "%d° | %s\n"
 		if failedTransfers > 0 {
-			transferFailRate := int8(float32(failedTransfers) / float32(cap(errCh)) * 100)
-			logger.Debugf("Transfers failed: %d/%d (%d%%)\n", failedTransfers, cap(errCh), transferFailRate)
+			transferFailRate := failRate(failedTransfers, transfers)
+			logger.Debugf("Transfers failed: %d/%d (%d%%)\n", failedTransfers, transfers, transferFailRate)
 
 			if transferFailRate > 10 {
 				str := lang.GetTranslator().LocalizeTemplate("FailedTransferNum", map[string]string{
@@ -119,7 +276,7 @@ func getStatus(errCh chan BackupError, preErrCh chan BackupError, postErrCh chan
 
 		// Append pre errors
 		if failedPre > 0 {
-			logger.Debugf("Pre-transfer commands failed: %d/%d", failedPre, cap(preErrCh))
+			logger.Debugf("Pre-transfer commands failed: %d/%d", failedPre, pres)
 			str := lang.GetTranslator().LocalizeTemplate("FailedPreNum", map[string]string{
 				"Failed": strconv.Itoa(failedPre),
 			}, langs...)
@@ -135,7 +292,7 @@ func getStatus(errCh chan BackupError, preErrCh chan BackupError, postErrCh chan
 
 		// Append post errors
 		if failedPost > 0 {
-			logger.Debugf("Post-transfer commands failed: %d/%d", failedPost, cap(postErrCh))
+			logger.Debugf("Post-transfer commands failed: %d/%d", failedPost, posts)
 			str := lang.GetTranslator().LocalizeTemplate("FailedPostNum", map[string]string{
 				"Failed": strconv.Itoa(failedPost),
 			}, langs...)
@@ -162,5 +319,57 @@ func getStatus(errCh chan BackupError, preErrCh chan BackupError, postErrCh chan
 		}
 		statusEmoji = colors[lev%len(colors)]
 	}
+
+	// Sum up what a simulated upload would have transferred
+	if session.Opts.Simulate && session.Opts.Uploading {
+		str := lang.GetTranslator().LocalizeTemplate("WouldTransfer", map[string]string{
+			"Files": strconv.Itoa(session.simulated.Files),
+			"Size":  rc_fs.SizeSuffix(session.simulated.Bytes).String(),
+		}, langs...)
+		status.WriteString("\n" + str + "\n")
+		logger.Info(str)
+	}
+
+	// Mention which snapshot was restored
+	if session.snapshot != nil {
+		str := lang.GetTranslator().LocalizeTemplate("RestoredSnapshot", map[string]string{
+			"ID":   session.snapshot.ID,
+			"Time": session.snapshot.Time.Local().Format(time.DateTime),
+		}, langs...)
+		status.WriteString("\n" + str + "\n")
+	}
+
+	// Append the paths matched by each glob pattern
+	if len(session.expansions) > 0 {
+		status.WriteString("\n")
+		for _, exp := range session.expansions {
+			str := lang.GetTranslator().LocalizeTemplate("PatternExpanded", map[string]string{
+				"Pattern": exp.Pattern,
+				"Count":   strconv.Itoa(len(exp.Matches)),
+			}, langs...)
+			status.WriteString(str + "\n")
+			for _, m := range exp.Matches {
+				status.WriteString(fmt.Sprintf("- %s\n", m))
+			}
+		}
+	}
+
+	// Append how the command graphs ended
+	status.WriteString(session.getGraphStatus(langs...))
+
+	// Append warnings, which never affect the outcome
+	if len(warnings) > 0 {
+		str := lang.GetTranslator().LocalizeTemplate("WarningNum", map[string]string{
+			"Warnings": strconv.Itoa(len(warnings)),
+		}, langs...)
+		status.WriteString("\n" + str + "\n")
+		logger.Debug(str)
+
+		for i, warn := range warnings {
+			s := fmt.Sprintf("%d° | %s\n", i+1, warn.Localize(langs...))
+			status.WriteString(s)
+			logger.Debug(s)
+		}
+	}
 	return status.String(), statusEmoji
 }
@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+)
+
+// FaultInjector decides which paths and commands fail on purpose.
+// Decisions only depend on the configuration and on the name of what is being tested,
+// so the same configuration always fails the same paths and commands.
+type FaultInjector struct {
+	faults config.Faults
+	codes  []BackupErrorCode
+}
+
+const (
+	faultPath    = "path"
+	faultCommand = "cmd"
+)
+
+// ParseFaults parses a fault specification given on the command line. It's a comma-separated list of:
+//
+//	path:<pattern>=<code>   fail the matching paths with the error code
+//	cmd:<pattern>=<code>    fail the matching commands with the error code
+//	rate=<0..1>             fail this share of the other paths and commands
+//	seed=<n>                choose which ones fail at the given rate
+//	code=<code>             error code used for failures at the given rate (can be repeated)
+func ParseFaults(spec string) (*config.Faults, error) {
+	faults := &config.Faults{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		// Patterns may contain '=' themselves, error codes and numbers can't
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid fault '%s': expected key=value", item)
+		}
+		key, value := item[:i], item[i+1:]
+
+		var err error
+		switch {
+		case strings.HasPrefix(key, faultPath+":"):
+			faults.Rules = append(faults.Rules, config.FaultRule{Path: strings.TrimPrefix(key, faultPath+":"), Code: value})
+		case strings.HasPrefix(key, faultCommand+":"):
+			faults.Rules = append(faults.Rules, config.FaultRule{Command: strings.TrimPrefix(key, faultCommand+":"), Code: value})
+		case key == "rate":
+			faults.Rate, err = strconv.ParseFloat(value, 64)
+		case key == "seed":
+			faults.Seed, err = strconv.ParseInt(value, 10, 64)
+		case key == "code":
+			faults.Codes = append(faults.Codes, value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault '%s': %w", item, err)
+		}
+	}
+	return faults, nil
+}
+
+// NewFaultInjector validates the fault configuration. It returns nil if no fault is configured.
+func NewFaultInjector(faults *config.Faults) (*FaultInjector, error) {
+	if faults == nil || (len(faults.Rules) == 0 && faults.Rate <= 0) {
+		return nil, nil
+	}
+	if faults.Rate < 0 || faults.Rate > 1 {
+		return nil, fmt.Errorf("invalid fault rate %v: must be between 0 and 1", faults.Rate)
+	}
+	for _, rule := range faults.Rules {
+		if (rule.Path == "") == (rule.Command == "") {
+			return nil, fmt.Errorf("invalid fault rule: exactly one of path and command must be set")
+		}
+		if _, err := ParseBackupErrorCode(rule.Code); err != nil {
+			return nil, err
+		}
+	}
+
+	injector := &FaultInjector{faults: *faults}
+	for _, name := range faults.Codes {
+		code, err := ParseBackupErrorCode(name)
+		if err != nil {
+			return nil, err
+		}
+		injector.codes = append(injector.codes, code)
+	}
+	if len(injector.codes) == 0 {
+		injector.codes = []BackupErrorCode{GenericError}
+	}
+	return injector, nil
+}
+
+// forPath returns the error to report for a path, if it must fail.
+func (fi *FaultInjector) forPath(path string) (BackupError, bool) {
+	return fi.inject(faultPath, path)
+}
+
+// forCommand returns the error to report for a command, if it must fail.
+func (fi *FaultInjector) forCommand(command string) (BackupError, bool) {
+	return fi.inject(faultCommand, command)
+}
+
+func (fi *FaultInjector) inject(kind string, source string) (BackupError, bool) {
+	if fi == nil {
+		return BackupError{}, false
+	}
+
+	for _, rule := range fi.faults.Rules {
+		pattern := rule.Path
+		if kind == faultCommand {
+			pattern = rule.Command
+		}
+		if pattern != "" && wildcardMatch(pattern, source) {
+			code, _ := ParseBackupErrorCode(rule.Code)
+			logger.Warnf("Injecting fault (%s): '%s'", code, source)
+			return code.Error(source, "injected fault"), true
+		}
+	}
+
+	if fi.faults.Rate > 0 {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d\x00%s\x00%s", fi.faults.Seed, kind, source)
+		sum := mix64(h.Sum64())
+		if float64(sum>>11)/float64(1<<53) < fi.faults.Rate {
+			code := fi.codes[sum%uint64(len(fi.codes))]
+			logger.Warnf("Injecting fault (%s, rate %v): '%s'", code, fi.faults.Rate, source)
+			return code.Error(source, "injected fault"), true
+		}
+	}
+	return BackupError{}, false
+}
+
+// mix64 spreads the bits of a hash, whose high bits barely change between similar names.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// wildcardMatch reports whether s matches the pattern, in which '*' matches any sequence of characters.
+func wildcardMatch(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything at all", true},
+		{"/srv/data", "/srv/data", true},
+		{"/srv/data", "/srv/data2", false},
+		{"/srv/*", "/srv/data/nested", true},
+		{"/srv/*", "/srv", false},
+		{"*.sql", "/var/backups/db.sql", true},
+		{"*.sql", "/var/backups/db.sql.gz", false},
+		{"*dump*", "pg_dump -U postgres", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		// Prefix and suffix can't overlap
+		{"a*a", "a", false},
+		{"*a*a", "aa", true},
+		// Other glob characters are literal
+		{"file?.txt", "file1.txt", false},
+		{"[ab]*", "[ab]c", true},
+	}
+
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	got, err := ParseFaults(" path:/srv/*=UploadError, cmd:pg_dump*=CmdFailed,cmd:export A=1=CmdFailed,,rate=0.2,seed=42,code=UploadError,code=DownloadError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config.Faults{
+		Rules: []config.FaultRule{
+			{Path: "/srv/*", Code: "UploadError"},
+			{Command: "pg_dump*", Code: "CmdFailed"},
+			{Command: "export A=1", Code: "CmdFailed"},
+		},
+		Rate:  0.2,
+		Seed:  42,
+		Codes: []string{"UploadError", "DownloadError"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseFaults() = %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"rate", "ratio=0.5", "rate=half", "seed=0.5", "rate=0.5=1"} {
+		if faults, err := ParseFaults(spec); err == nil {
+			t.Errorf("ParseFaults(%q) = %+v, want an error", spec, faults)
+		}
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	fi, err := NewFaultInjector(&config.Faults{
+		Rules: []config.FaultRule{{Command: "pg_dump*", Code: "CmdFailed"}},
+		Rate:  0.5,
+		Seed:  7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fault, ok := fi.forCommand("pg_dump app"); !ok || fault.Code != CmdFailed {
+		t.Errorf("forCommand(pg_dump app) = %+v, %v, want a %v fault", fault, ok, CmdFailed)
+	}
+
+	// The same seed fails the same paths, and roughly as many as the rate says
+	again, _ := NewFaultInjector(&config.Faults{Rate: 0.5, Seed: 7})
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/srv/file%d", i)
+		_, ok := fi.forPath(path)
+		if _, same := again.forPath(path); ok != same {
+			t.Fatalf("forPath(%q) = %v, then %v", path, ok, same)
+		}
+		if ok {
+			failed++
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Errorf("%d/1000 paths failed at rate 0.5", failed)
+	}
+
+	for _, faults := range []*config.Faults{
+		{Rate: 1.5},
+		{Rules: []config.FaultRule{{Code: "CmdFailed"}}},
+		{Rules: []config.FaultRule{{Path: "/srv", Command: "ls", Code: "CmdFailed"}}},
+		{Rules: []config.FaultRule{{Path: "/srv", Code: "NoSuchCode"}}},
+	} {
+		if _, err := NewFaultInjector(faults); err == nil {
+			t.Errorf("NewFaultInjector(%+v) accepted an invalid configuration", faults)
+		}
+	}
+}
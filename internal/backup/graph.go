@@ -0,0 +1,361 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/lang"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+)
+
+// DefaultCommandParallelism is how many commands of a graph may run at the same time, unless configured.
+const DefaultCommandParallelism = 4
+
+type nodeState int
+
+const (
+	nodePending nodeState = iota
+	nodeRunning
+	nodeSucceeded
+	nodeFailed
+	nodeSkipped
+)
+
+// cmdNode is a command of a graph, which only runs once the commands it needs have succeeded.
+type cmdNode struct {
+	ordinal int
+	command config.Command
+	needs   []*cmdNode
+	state   nodeState
+	// Whether the command can't run, because of how it's declared or because it needs one that can't
+	invalid bool
+	// The invalid commands it needs
+	invalidNeeds []string
+	// The errors of the command, forwarded when it ends
+	errs *ErrorList
+	// The state the command runs with, which the commands needing it start from
+	opts *CommandOpts
+}
+
+type nodeResult struct {
+	node   *cmdNode
+	result cmdResult
+}
+
+// CmdGraph is the outcome of a list of commands run as a dependency graph.
+type CmdGraph struct {
+	Phase     string       `json:"phase"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Skipped   []SkippedCmd `json:"skipped,omitempty"`
+}
+
+// SkippedCmd is a command of a graph that was never executed, because it's invalid, because the commands it needs
+// didn't succeed or because the graph was stopped before its turn.
+type SkippedCmd struct {
+	Name  string   `json:"name"`
+	Needs []string `json:"needs,omitempty"`
+}
+
+func (n *cmdNode) name() string {
+	if n.command.ID != "" {
+		return n.command.ID
+	}
+	return n.command.String()
+}
+
+// isGraph reports whether any of the commands depends on another, which makes them run as a graph.
+func isGraph(commands []config.Command) bool {
+	for _, c := range commands {
+		if len(c.Needs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGraph links the commands to those they need, reporting an error for each command that can't run:
+// ids must be unique, needs must refer to them, and there can be no cycles. Commands that can't run are marked invalid.
+func buildGraph(commands []config.Command) ([]*cmdNode, []BackupError) {
+	nodes := make([]*cmdNode, len(commands))
+	byID := make(map[string]*cmdNode)
+	var errs []BackupError
+
+	for i, c := range commands {
+		n := &cmdNode{ordinal: i + 1, command: c}
+		nodes[i] = n
+		if c.ID == "" {
+			continue
+		}
+		if _, ok := byID[c.ID]; ok {
+			errs = append(errs, CmdInvalid.Error(n.name(), fmt.Sprintf("duplicate id '%s'", c.ID)))
+			n.invalid = true
+			continue
+		}
+		byID[c.ID] = n
+	}
+
+	for _, n := range nodes {
+		if n.invalid {
+			continue
+		}
+		for _, id := range n.command.Needs {
+			need, ok := byID[id]
+			if !ok || need == n {
+				errs = append(errs, CmdInvalid.Error(n.name(), fmt.Sprintf("needs unknown command '%s'", id)))
+				n.invalid = true
+				break
+			}
+			n.needs = append(n.needs, need)
+		}
+	}
+
+	// Commands needing one that can't run can't run either
+	for progress := true; progress; {
+		progress = false
+		for _, n := range nodes {
+			if n.invalid {
+				continue
+			}
+			for _, need := range n.needs {
+				if need.invalid {
+					errs = append(errs, CmdInvalid.Error(n.name(), fmt.Sprintf("needs invalid command '%s'", need.name())))
+					n.invalid = true
+					n.invalidNeeds = append(n.invalidNeeds, need.name())
+					progress = true
+					break
+				}
+			}
+		}
+	}
+
+	// Whatever can't be sorted is part of a cycle, or needs a command that is
+	resolved := make(map[*cmdNode]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, n := range nodes {
+			if resolved[n] || n.invalid {
+				continue
+			}
+			ready := true
+			for _, need := range n.needs {
+				ready = ready && resolved[need]
+			}
+			if ready {
+				resolved[n] = true
+				progress = true
+			}
+		}
+	}
+	for _, n := range nodes {
+		if !resolved[n] && !n.invalid {
+			errs = append(errs, CmdInvalid.Error(n.name(), "dependency cycle"))
+			n.invalid = true
+		}
+	}
+	return nodes, errs
+}
+
+// executeGraph runs commands as soon as the commands they need have succeeded, a few at a time.
+// Commands needing one that failed or was skipped are skipped in turn, and so are invalid commands.
+// Each command starts from the state the last command it needs left, or from opts if it needs none,
+// so that commands running at the same time don't change each other's. In a persistent shell they all share opts.
+func (session *BackupSession) executeGraph(errs *ErrorList, opts *CommandOpts, commands []config.Command, phase string, shell *shellSession) cmdsOutcome {
+	abortOnFailure := phase == phasePre && session.abortOnPreFailure()
+
+	// A persistent shell runs one command at a time
+	parallelism := session.commandParallelism()
+	if shell != nil {
+		parallelism = 1
+	}
+
+	graph := CmdGraph{Phase: phase}
+	outcome := cmdsCompleted
+	stopped := false
+
+	// Invalid commands are skipped, like those that need them, and fail the run the way failed commands would
+	nodes, invalid := buildGraph(commands)
+	for _, err := range invalid {
+		logger.Errorf("Invalid command graph: '%s' - %s", err.Source, err.Message)
+		errs.Add(err)
+	}
+	for _, n := range nodes {
+		if !n.invalid {
+			continue
+		}
+		n.state = nodeSkipped
+		graph.Skipped = append(graph.Skipped, SkippedCmd{Name: n.name(), Needs: n.invalidNeeds})
+		if phase == phasePre && (n.command.Critical || abortOnFailure) && !stopped {
+			logger.Errorf("%d° is invalid: the remaining commands will not be executed", n.ordinal)
+			outcome = cmdsAborted
+			stopped = true
+		}
+	}
+	logger.Debugf("Running %d %s commands as a graph, %d at a time", len(nodes)-len(graph.Skipped), phase, parallelism)
+
+	running := 0
+	results := make(chan nodeResult)
+
+	for {
+		// Nothing else starts once the session is cancelled
+		if err := session.context.Err(); err != nil && !stopped {
+			logger.Warn("Session cancelled: the remaining commands will not be executed")
+			stopped = true
+			if phase == phasePre {
+				outcome = cmdsAborted
+			}
+		}
+
+		// Skip the commands whose needs can no longer succeed
+		for changed := true; changed; {
+			changed = false
+			for _, n := range nodes {
+				if n.state != nodePending {
+					continue
+				}
+				var failed []string
+				for _, need := range n.needs {
+					if need.state == nodeFailed || need.state == nodeSkipped {
+						failed = append(failed, need.name())
+					}
+				}
+				if len(failed) > 0 {
+					logger.Warnf("%d° (%s) skipped: '%s' did not succeed", n.ordinal, n.name(), strings.Join(failed, "', '"))
+					n.state = nodeSkipped
+					graph.Skipped = append(graph.Skipped, SkippedCmd{Name: n.name(), Needs: failed})
+					changed = true
+				}
+			}
+		}
+
+		// Start the commands that are ready, in the order they were configured
+		for _, n := range nodes {
+			if stopped || running >= parallelism {
+				break
+			}
+			if n.state != nodePending {
+				continue
+			}
+			ready := true
+			for _, need := range n.needs {
+				ready = ready && need.state == nodeSucceeded
+			}
+			if !ready {
+				continue
+			}
+
+			n.state = nodeRunning
+			n.errs = &ErrorList{}
+			switch {
+			case shell != nil:
+				n.opts = opts
+			case len(n.needs) > 0:
+				n.opts = n.needs[len(n.needs)-1].opts.clone()
+			default:
+				n.opts = opts.clone()
+			}
+			running++
+			go func(n *cmdNode) {
+				var result cmdResult
+				if n.command.Plain() && shell == nil {
+					result = session.executeCmdLine(n.errs, n.opts, n.ordinal, n.command.Run, phase)
+				} else {
+					result = session.executeWithRetries(n.errs, n.opts, n.ordinal, n.command, phase, shell)
+				}
+				results <- nodeResult{node: n, result: result}
+			}(n)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		// Wait for any command to end
+		r := <-results
+		running--
+		errs.Attempt(r.node.errs)
+
+		n := r.node
+		switch {
+		case r.result == cmdSucceeded:
+			n.state = nodeSucceeded
+			graph.Succeeded++
+		case r.result == cmdSkipRun:
+			n.state = nodeSucceeded
+			graph.Succeeded++
+			if outcome == cmdsCompleted {
+				logger.Infof("%d° asked to skip the run", n.ordinal)
+				outcome = cmdsSkipped
+			}
+			stopped = true
+		default:
+			n.state = nodeFailed
+			graph.Failed++
+			switch {
+			case phase == phasePre && (n.command.Critical || abortOnFailure):
+				logger.Errorf("%d° failed: the remaining commands will not be executed", n.ordinal)
+				outcome = cmdsAborted
+				stopped = true
+			case !n.command.ContinuesOnError():
+				logger.Warnf("%d° failed: the remaining commands will not be executed", n.ordinal)
+				stopped = true
+			}
+		}
+	}
+
+	// Commands left behind when the graph was stopped
+	for _, n := range nodes {
+		if n.state == nodePending {
+			n.state = nodeSkipped
+			graph.Skipped = append(graph.Skipped, SkippedCmd{Name: n.name()})
+		}
+	}
+
+	logger.Infof("Command graph (%s): %d succeeded, %d failed, %d skipped", phase, graph.Succeeded, graph.Failed, len(graph.Skipped))
+	session.graphs = append(session.graphs, graph)
+	return outcome
+}
+
+// commandParallelism returns how many commands of a graph may run at the same time.
+func (session *BackupSession) commandParallelism() int {
+	if session.Machine.CommandParallelism > 0 {
+		return session.Machine.CommandParallelism
+	}
+	return DefaultCommandParallelism
+}
+
+// getGraphStatus describes how the command graphs of the session ended.
+func (session *BackupSession) getGraphStatus(langs ...string) string {
+	if len(session.graphs) == 0 {
+		return ""
+	}
+
+	var status strings.Builder
+	status.WriteString("\n")
+	for _, graph := range session.graphs {
+		str := lang.GetTranslator().LocalizeTemplate("CommandGraph", map[string]string{
+			"Phase":     graph.Phase,
+			"Succeeded": strconv.Itoa(graph.Succeeded),
+			"Failed":    strconv.Itoa(graph.Failed),
+			"Skipped":   strconv.Itoa(len(graph.Skipped)),
+		}, langs...)
+		status.WriteString(str + "\n")
+
+		for _, skipped := range graph.Skipped {
+			if len(skipped.Needs) == 0 {
+				str = lang.GetTranslator().LocalizeTemplate("CommandNotRun", map[string]string{
+					"Name": skipped.Name,
+				}, langs...)
+			} else {
+				str = lang.GetTranslator().LocalizeTemplate("CommandSkipped", map[string]string{
+					"Name":  skipped.Name,
+					"Needs": strings.Join(skipped.Needs, "', '"),
+				}, langs...)
+			}
+			status.WriteString(fmt.Sprintf("- %s\n", str))
+		}
+	}
+	return status.String()
+}
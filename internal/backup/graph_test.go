@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+// cmd returns a command with an id, needing others.
+func cmd(id string, needs ...string) config.Command {
+	return config.Command{ID: id, Run: "true", Needs: needs}
+}
+
+func TestBuildGraph(t *testing.T) {
+	nodes, errs := buildGraph([]config.Command{
+		cmd("d", "b", "c"),
+		cmd("b", "a"),
+		cmd("c", "a"),
+		cmd("a"),
+		{Run: "echo no id", Needs: []string{"a"}},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("buildGraph() reported %+v", errs)
+	}
+
+	want := [][]int{{2, 3}, {4}, {4}, {}, {4}}
+	for i, n := range nodes {
+		got := []int{}
+		for _, need := range n.needs {
+			got = append(got, need.ordinal)
+		}
+		if !slices.Equal(got, want[i]) {
+			t.Errorf("%d° needs %v, want %v", i+1, got, want[i])
+		}
+	}
+}
+
+func TestBuildGraphErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []config.Command
+		want     []string
+	}{
+		{
+			name:     "needs itself",
+			commands: []config.Command{cmd("a", "a")},
+			want:     []string{"a: needs unknown command 'a'"},
+		},
+		{
+			name:     "unknown need",
+			commands: []config.Command{cmd("a"), cmd("b", "a", "z")},
+			want:     []string{"b: needs unknown command 'z'"},
+		},
+		{
+			name:     "duplicate id",
+			commands: []config.Command{cmd("a"), cmd("a"), cmd("b", "a")},
+			want:     []string{"a: duplicate id 'a'"},
+		},
+		{
+			name:     "cycle",
+			commands: []config.Command{cmd("ok"), cmd("a", "c", "ok"), cmd("b", "a"), cmd("c", "b")},
+			want:     []string{"a: dependency cycle", "b: dependency cycle", "c: dependency cycle"},
+		},
+		{
+			name:     "needing a cycle",
+			commands: []config.Command{cmd("a", "b"), cmd("b", "a"), cmd("c", "a")},
+			want:     []string{"a: dependency cycle", "b: dependency cycle", "c: dependency cycle"},
+		},
+		{
+			name:     "needing an invalid command",
+			commands: []config.Command{cmd("c", "b"), cmd("b", "a"), cmd("a", "z")},
+			want:     []string{"a: needs unknown command 'z'", "b: needs invalid command 'a'", "c: needs invalid command 'b'"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := buildGraph(tt.commands)
+			var got []string
+			for _, err := range errs {
+				if err.Code != CmdInvalid {
+					t.Errorf("%s: code %v, want %v", err.Source, err.Code, CmdInvalid)
+				}
+				got = append(got, err.Source+": "+err.Message)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("errors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteGraph(t *testing.T) {
+	dir := t.TempDir()
+	session := newTestSession(&config.Machine{})
+	commands := []config.Command{
+		// Would fail if it ran before 'dump'
+		{ID: "upload", Run: "test -f '" + dir + "/dump'", Needs: []string{"dump"}},
+		{ID: "dump", Run: "sleep 0.2; touch '" + dir + "/dump'"},
+		{ID: "lint", Run: "false"},
+		{ID: "report", Run: "true", Needs: []string{"lint"}},
+		{ID: "publish", Run: "true", Needs: []string{"report", "upload"}},
+	}
+
+	outcome, errs := runCmds(session, phasePost, commands...)
+
+	if outcome != cmdsCompleted {
+		t.Errorf("outcome = %v, want %v", outcome, cmdsCompleted)
+	}
+	if len(errs) != 1 || errs[0].Source != "false" {
+		t.Errorf("errors = %+v, want the failure of 'lint' only", errs)
+	}
+	want := []CmdGraph{{
+		Phase:     phasePost,
+		Succeeded: 2,
+		Failed:    1,
+		Skipped: []SkippedCmd{
+			{Name: "report", Needs: []string{"lint"}},
+			{Name: "publish", Needs: []string{"report"}},
+		},
+	}}
+	if !reflect.DeepEqual(session.graphs, want) {
+		t.Errorf("graphs = %+v, want %+v", session.graphs, want)
+	}
+}
+
+func TestExecuteInvalidGraph(t *testing.T) {
+	next, ran := touch(t)
+	next.ID = "next"
+	commands := []config.Command{next, {ID: "broken", Run: "true", Needs: []string{"missing"}, Critical: true}}
+
+	outcome, errs := runCmds(newTestSession(&config.Machine{}), phasePre, commands...)
+	if outcome != cmdsAborted {
+		t.Errorf("outcome = %v, want %v", outcome, cmdsAborted)
+	}
+	if len(errs) != 1 || errs[0].Code != CmdInvalid {
+		t.Errorf("errors = %+v, want a single %v", errs, CmdInvalid)
+	}
+	if ran() {
+		t.Error("a command of an invalid graph ran")
+	}
+}
+
+func TestExecutePartlyInvalidGraph(t *testing.T) {
+	next, ran := touch(t)
+	next.ID = "next"
+	session := newTestSession(&config.Machine{})
+	commands := []config.Command{
+		next,
+		{ID: "broken", Run: "true", Needs: []string{"missing"}},
+		{ID: "report", Run: "true", Needs: []string{"broken"}},
+		{ID: "publish", Run: "true", Needs: []string{"next"}},
+	}
+
+	outcome, errs := runCmds(session, phasePost, commands...)
+	if outcome != cmdsCompleted {
+		t.Errorf("outcome = %v, want %v", outcome, cmdsCompleted)
+	}
+	if len(errs) != 2 || errs[0].Source != "broken" || errs[1].Source != "report" {
+		t.Errorf("errors = %+v, want 'broken' and 'report' reported as invalid", errs)
+	}
+	if !ran() {
+		t.Error("a valid command didn't run")
+	}
+	want := []CmdGraph{{
+		Phase:     phasePost,
+		Succeeded: 2,
+		Skipped: []SkippedCmd{
+			{Name: "broken"},
+			{Name: "report", Needs: []string{"broken"}},
+		},
+	}}
+	if !reflect.DeepEqual(session.graphs, want) {
+		t.Errorf("graphs = %+v, want %+v", session.graphs, want)
+	}
+}
+
+func TestGraphBranchesKeepTheirState(t *testing.T) {
+	left, right := t.TempDir(), t.TempDir()
+	branch := func(id, dir string) []config.Command {
+		cd := config.NewCommand("cd " + dir + " & sleep 0.1s & export SIDE=" + id)
+		cd.ID = id
+		return []config.Command{cd, {ID: id + "-check", Run: `test "$SIDE" = ` + id + ` && touch ok`, Needs: []string{id}}}
+	}
+	commands := append(branch("left", left), branch("right", right)...)
+	// Commands needing none start from the state all of them started with
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	commands = append(commands, config.Command{ID: "base", Run: `sleep 0.3; test -z "$SIDE" && test "$PWD" = '` + wd + `' && touch '` + dir + `/base-ok'`})
+
+	outcome, errs := runCmds(newTestSession(&config.Machine{}), phasePost, commands...)
+	if outcome != cmdsCompleted || len(errs) > 0 {
+		t.Errorf("outcome = %v, errors = %+v, want every command to succeed", outcome, errs)
+	}
+	for _, file := range []string{filepath.Join(left, "ok"), filepath.Join(right, "ok"), filepath.Join(dir, "base-ok")} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("a branch lost its state: %s", err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	rc_fs "github.com/rclone/rclone/fs"
+	rc_walk "github.com/rclone/rclone/fs/walk"
+)
+
+// RemoteEntry is a file backed up on the remote.
+type RemoteEntry struct {
+	Path    string    `json:"path"`
+	Remote  string    `json:"remote"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// List returns the files backed up for the session's machine, optionally limited to a local path.
+// Each file is reported with the local path it was uploaded from.
+func (session *BackupSession) List(path string) ([]RemoteEntry, error) {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return nil, err
+	}
+	rootFs, err := rc_fs.NewFs(session.context, root)
+	if err != nil {
+		return nil, err
+	}
+
+	rel := ""
+	if path != "" {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if rel, err = session.getRemoteRel(absPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []RemoteEntry
+	add := func(obj rc_fs.Object) {
+		if isMetaPath(obj.Remote()) {
+			return
+		}
+		entries = append(entries, RemoteEntry{
+			Path:    session.decodeRemotePath(obj.Remote()),
+			Remote:  obj.Remote(),
+			Size:    obj.Size(),
+			ModTime: obj.ModTime(session.context),
+		})
+	}
+
+	// A single file
+	if obj, err := rootFs.NewObject(session.context, rel); rel != "" && err == nil {
+		add(obj)
+		return entries, nil
+	}
+
+	// Nothing was backed up
+	if _, err := rootFs.List(session.context, rel); errors.Is(err, rc_fs.ErrorDirNotFound) {
+		return entries, nil
+	}
+
+	err = rc_walk.ListR(session.context, rootFs, rel, false, -1, rc_walk.ListObjects, func(dirEntries rc_fs.DirEntries) error {
+		dirEntries.ForObject(add)
+		return nil
+	})
+	if err != nil && !errors.Is(err, rc_fs.ErrorDirNotFound) {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// getRemoteRel returns where a local path is stored, relative to the machine's directory on the remote.
+func (session *BackupSession) getRemoteRel(path string) (string, error) {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return "", err
+	}
+	remotePath, err := session.getRemotePath(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(remotePath, root), "/"), nil
+}
+
+// decodeRemotePath returns the local path a file on the remote was uploaded from.
+// The configured paths are used when possible, since characters the remote doesn't allow were removed.
+func (session *BackupSession) decodeRemotePath(rel string) string {
+	longest := -1
+	decoded := ""
+	for _, p := range session.Machine.PathList() {
+		if isPattern(p) {
+			p, _ = splitPattern(p)
+		}
+		pRel, err := session.getRemoteRel(p)
+		if err != nil || len(pRel) <= longest {
+			continue
+		}
+
+		switch {
+		case rel == pRel:
+			decoded = p
+		case strings.HasPrefix(rel, pRel+"/"):
+			decoded = filepath.Join(p, filepath.FromSlash(strings.TrimPrefix(rel, pRel+"/")))
+		default:
+			continue
+		}
+		longest = len(pRel)
+	}
+
+	if decoded == "" {
+		decoded = filepath.FromSlash("/" + rel)
+	}
+	return decoded
+}
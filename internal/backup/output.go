@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+)
+
+// DefaultStderrLimit is how many bytes of a command's error output are kept for its error message, unless configured.
+const DefaultStderrLimit = 4096
+
+// Longer lines are logged in pieces, so that output without line breaks can't grow forever
+const maxLineLength = 64 * 1024
+
+// outputWriter logs what a command writes as it writes it, one line at a time, prefixed by the
+// phase and the ordinal of the command: "[pre 2°] ...". Only the last bytes written are kept, up to a limit.
+type outputWriter struct {
+	prefix    string
+	log       func(string, ...interface{})
+	line      []byte
+	tail      []byte
+	limit     int
+	truncated bool
+}
+
+// newOutputWriter returns a writer logging with the given function, or only keeping the output if it's nil.
+func newOutputWriter(phase string, ordinal int, log func(string, ...interface{}), limit int) *outputWriter {
+	return &outputWriter{
+		prefix: fmt.Sprintf("[%s %d°]", phase, ordinal),
+		log:    log,
+		limit:  limit,
+	}
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.keep(p)
+	if w.log == nil {
+		return len(p), nil
+	}
+
+	rest := p
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			w.line = append(w.line, rest...)
+			if len(w.line) >= maxLineLength {
+				w.flush()
+			}
+			break
+		}
+		w.line = append(w.line, rest[:i]...)
+		w.flush()
+		rest = rest[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close logs the last line, even if it's incomplete.
+func (w *outputWriter) Close() error {
+	if len(w.line) > 0 {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *outputWriter) flush() {
+	w.log("%s %s", w.prefix, strings.TrimSuffix(string(w.line), "\r"))
+	w.line = w.line[:0]
+}
+
+// keep appends to the kept output, dropping its beginning once it's over the limit.
+func (w *outputWriter) keep(p []byte) {
+	if w.limit <= 0 {
+		return
+	}
+	w.tail = append(w.tail, p...)
+	if over := len(w.tail) - w.limit; over > 0 {
+		w.tail = w.tail[over:]
+		// Don't start in the middle of a character
+		for len(w.tail) > 0 && !utf8.RuneStart(w.tail[0]) {
+			w.tail = w.tail[1:]
+		}
+		w.truncated = true
+	}
+}
+
+// String returns the kept output, marking whether its beginning was dropped.
+func (w *outputWriter) String() string {
+	s := strings.TrimSpace(string(w.tail))
+	if w.truncated {
+		return "..." + s
+	}
+	return s
+}
+
+// outputWriters returns where a command writes its output. Its standard output is only logged if wanted,
+// while its errors are always logged, and their end is kept for the error message.
+func (session *BackupSession) outputWriters(phase string, ordinal int, output bool) (*outputWriter, *outputWriter) {
+	var logOutput func(string, ...interface{})
+	if output {
+		logOutput = logger.Infof
+	}
+	return newOutputWriter(phase, ordinal, logOutput, 0), newOutputWriter(phase, ordinal, logger.Warnf, session.stderrLimit())
+}
+
+// stderrLimit returns how many bytes of a command's error output are kept for its error message.
+func (session *BackupSession) stderrLimit() int {
+	if session.Machine.StderrLimit > 0 {
+		return session.Machine.StderrLimit
+	}
+	return DefaultStderrLimit
+}
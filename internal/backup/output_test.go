@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lineRecorder collects what an outputWriter logs.
+type lineRecorder []string
+
+func (r *lineRecorder) log(format string, args ...interface{}) {
+	*r = append(*r, fmt.Sprintf(format, args...))
+}
+
+func TestOutputWriterLines(t *testing.T) {
+	var lines lineRecorder
+	w := newOutputWriter(phasePre, 2, lines.log, 0)
+
+	for _, chunk := range []string{"first li", "ne\nsecond line\r\n", "\nthird", " without break"} {
+		w.Write([]byte(chunk))
+	}
+	if len(lines) != 3 {
+		t.Errorf("logged %q before Close, want 3 complete lines", lines)
+	}
+	w.Close()
+
+	want := lineRecorder{
+		"[pre 2°] first line",
+		"[pre 2°] second line",
+		"[pre 2°] ",
+		"[pre 2°] third without break",
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("logged %q, want %q", lines, want)
+	}
+}
+
+func TestOutputWriterLongLines(t *testing.T) {
+	var lines lineRecorder
+	w := newOutputWriter(phasePost, 1, lines.log, 0)
+
+	chunk := []byte(strings.Repeat("x", 1024))
+	for i := 0; i < maxLineLength/len(chunk)+1; i++ {
+		w.Write(chunk)
+	}
+	w.Close()
+
+	if len(lines) != 2 || len(lines[1]) != len("[post 1°] ")+len(chunk) {
+		t.Errorf("a line longer than %d bytes was logged in %d pieces", maxLineLength, len(lines))
+	}
+}
+
+func TestOutputWriterKeepsTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"under the limit", 100, []string{"error: ", "disk full\n"}, "error: disk full"},
+		{"over the limit", 10, []string{"0123456789", "abcdef\n"}, "...789abcdef"},
+		{"no limit keeps nothing", 0, []string{"error\n"}, ""},
+		// 'é' takes two bytes: half of it is dropped with the rest
+		{"multi-byte characters", 5, []string{"ééé"}, "...éé"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing is logged, but the output is still kept
+			w := newOutputWriter(phasePre, 1, nil, tt.limit)
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			w.Close()
+			if got := w.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
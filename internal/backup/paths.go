@@ -0,0 +1,337 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+)
+
+// Backends that treat 'File' and 'file' as the same object
+var caseInsensitiveBackends = map[string]bool{
+	"dropbox": true,
+}
+
+// PatternExpansion records the concrete paths a glob pattern matched.
+type PatternExpansion struct {
+	Pattern string
+	Matches []string
+}
+
+// expandPaths replaces glob patterns with the paths they currently match.
+// Besides the usual wildcards ('*', '?', '[...]'), a '**' component matches any number of directories.
+// Plain paths are returned as they are, whether they exist or not. Patterns that match nothing are
+// returned as warnings, malformed ones as errors.
+func expandPaths(paths []string) ([]string, []PatternExpansion, []BackupError, []BackupError) {
+	var expanded []string
+	var expansions []PatternExpansion
+	var unmatched []BackupError
+	var invalid []BackupError
+
+	for _, p := range paths {
+		if !isPattern(p) {
+			expanded = append(expanded, p)
+			continue
+		}
+
+		matches, err := expandPattern(p)
+		if err != nil {
+			logger.Errorf("Invalid pattern '%s': %s", p, err)
+			invalid = append(invalid, PathError.Error(p, err.Error()))
+			continue
+		}
+		if len(matches) == 0 {
+			logger.Warnf("Pattern matched nothing: '%s'", p)
+			unmatched = append(unmatched, PatternNoMatch.Error(p, ""))
+			continue
+		}
+		logger.Debugf("Pattern '%s' matched %d paths: %v", p, len(matches), matches)
+		expansions = append(expansions, PatternExpansion{Pattern: p, Matches: matches})
+		expanded = append(expanded, matches...)
+	}
+	return expanded, expansions, unmatched, invalid
+}
+
+// pathHooks maps every path to transfer to the configured entries with commands that it covers: its own, those of
+// the patterns it was matched by, and those of the paths nested inside it or duplicating it, which are transferred with it.
+// The commands of a pattern run around the transfer of each path it matched.
+func pathHooks(entries []config.PathEntry, expansions []PatternExpansion, paths []string) map[string][]*config.PathEntry {
+	hooks := make(map[string][]*config.PathEntry)
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.HasHooks() {
+			continue
+		}
+
+		// Patterns that matched nothing have nothing to run around
+		sources := []string{entry.Path}
+		if isPattern(entry.Path) {
+			sources = nil
+		}
+		for _, exp := range expansions {
+			if exp.Pattern == entry.Path {
+				sources = exp.Matches
+			}
+		}
+
+		for _, source := range sources {
+			path := coveringPath(source, paths)
+			if path != "" && !slices.Contains(hooks[path], entry) {
+				hooks[path] = append(hooks[path], entry)
+			}
+		}
+	}
+	return hooks
+}
+
+func hasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// isPattern reports whether a configured path is a glob pattern. A path that exists as written
+// is taken literally, even if its name happens to contain wildcards, like "[2024] Taxes".
+func isPattern(p string) bool {
+	if !hasGlobMeta(p) {
+		return false
+	}
+	_, err := os.Lstat(p)
+	return err != nil
+}
+
+// splitPattern separates the leading components of a pattern that contain no wildcards
+// from the rest, which is returned using forward slashes.
+func splitPattern(pattern string) (string, string) {
+	components := strings.Split(filepath.ToSlash(pattern), "/")
+	for i, c := range components {
+		if hasGlobMeta(c) {
+			prefix := strings.Join(components[:i], "/")
+			if prefix == "" {
+				prefix = "/"
+			}
+			return filepath.FromSlash(prefix), strings.Join(components[i:], "/")
+		}
+	}
+	return pattern, ""
+}
+
+// expandPattern returns the sorted list of existing paths matching the pattern,
+// or an error if the pattern is malformed.
+func expandPattern(pattern string) ([]string, error) {
+	pattern = filepath.FromSlash(pattern)
+	volume := filepath.VolumeName(pattern)
+	rest := pattern[len(volume):]
+
+	base := volume
+	if strings.HasPrefix(rest, string(os.PathSeparator)) {
+		base += string(os.PathSeparator)
+	} else if base == "" {
+		base = "."
+	}
+
+	var components []string
+	for _, c := range strings.Split(rest, string(os.PathSeparator)) {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+
+	// Malformed components would otherwise just match nothing
+	for _, c := range components {
+		if _, err := filepath.Match(c, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	found := make(map[string]bool)
+	matchComponents(base, components, found)
+
+	matches := make([]string, 0, len(found))
+	for m := range found {
+		matches = append(matches, m)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchComponents walks base looking for entries that match the remaining pattern components,
+// which must be well-formed.
+func matchComponents(base string, components []string, found map[string]bool) {
+	if len(components) == 0 {
+		found[base] = true
+		return
+	}
+	head, tail := components[0], components[1:]
+
+	switch {
+	case head == "**":
+		// Zero directories...
+		matchComponents(base, tail, found)
+		// ...or any number of them
+		entries, err := os.ReadDir(base)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				matchComponents(filepath.Join(base, e.Name()), components, found)
+			}
+		}
+	case hasGlobMeta(head):
+		entries, err := os.ReadDir(base)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			// Names containing wildcards match themselves too
+			if ok, _ := filepath.Match(head, e.Name()); !ok && e.Name() != head {
+				continue
+			}
+			if len(tail) > 0 && !e.IsDir() {
+				continue
+			}
+			matchComponents(filepath.Join(base, e.Name()), tail, found)
+		}
+	default:
+		next := filepath.Join(base, head)
+		if _, err := os.Lstat(next); err == nil {
+			matchComponents(next, tail, found)
+		}
+	}
+}
+
+// resolvePaths analyses the machine's configured paths before any transfer takes place.
+// Duplicates and paths nested inside other configured paths are dropped, because they
+// would be transferred twice. Paths that end up at the same remote destination are kept,
+// but reported. Every conflict found is returned alongside the paths to transfer.
+func (session *BackupSession) resolvePaths(paths []string) ([]string, []BackupError) {
+	var resolved []string
+	var conflicts []BackupError
+
+	// Duplicates after cleaning and making absolute
+	seen := make(map[string]string)
+	var unique []string
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
+		}
+		if first, ok := seen[abs]; ok {
+			logger.Warnf("Path '%s' is a duplicate of '%s'", p, first)
+			conflicts = append(conflicts, PathDuplicate.Error(p, first))
+			continue
+		}
+		seen[abs] = p
+		unique = append(unique, p)
+	}
+
+	// Paths contained in other configured paths
+	for _, p := range unique {
+		if parent := findParentPath(p, unique); parent != "" {
+			logger.Warnf("Path '%s' is already included in '%s'", p, parent)
+			conflicts = append(conflicts, PathNested.Error(p, parent))
+			continue
+		}
+		resolved = append(resolved, p)
+	}
+
+	// Different local paths mapped to the same remote destination
+	foldCase := session.remoteCaseInsensitive()
+	destinations := make(map[string]string)
+	for _, p := range resolved {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		dest, err := session.getRemotePath(abs)
+		if err != nil {
+			continue
+		}
+		if foldCase {
+			dest = strings.ToLower(dest)
+		}
+		if first, ok := destinations[dest]; ok {
+			logger.Warnf("Paths '%s' and '%s' have the same remote destination", first, p)
+			conflicts = append(conflicts, PathCollision.Error(p, first))
+			continue
+		}
+		destinations[dest] = p
+	}
+
+	return resolved, conflicts
+}
+
+// findParentPath returns the first path in the list that contains p, if any.
+func findParentPath(p string, paths []string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+	for _, other := range paths {
+		otherAbs, err := filepath.Abs(other)
+		if err != nil || otherAbs == abs {
+			continue
+		}
+		if isSubPath(otherAbs, abs) {
+			return other
+		}
+	}
+	return ""
+}
+
+// coveringPath returns the path of the list that transfers p: p itself, however it is written, or the path containing it.
+func coveringPath(p string, paths []string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		abs = p
+	}
+	for _, other := range paths {
+		if otherAbs, err := filepath.Abs(other); err == nil && otherAbs == abs {
+			return other
+		}
+	}
+	return findParentPath(p, paths)
+}
+
+// isSubPath reports whether child is located inside parent. Both must be absolute.
+func isSubPath(parent string, child string) bool {
+	rel, err := filepath.Rel(parent, child)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// remoteCaseInsensitive reports whether the session's remote ignores case in file names.
+func (session *BackupSession) remoteCaseInsensitive() bool {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return false
+	}
+	info, _, _, _, err := rc_fs.ParseRemote(root)
+	if err != nil {
+		return false
+	}
+	if info.Name == "local" {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	return caseInsensitiveBackends[info.Name]
+}
+
+// failOnConflicts reports whether the machine is configured to abort when its paths conflict.
+func (session *BackupSession) failOnConflicts() bool {
+	switch session.Machine.PathConflicts {
+	case "", config.ConflictsWarn:
+		return false
+	case config.ConflictsFail:
+		return true
+	default:
+		logger.Warnf("Unknown value for path_conflicts: '%s' (using '%s')", session.Machine.PathConflicts, config.ConflictsWarn)
+		return false
+	}
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+// makeTree creates files, and the directories containing them, under a temporary root.
+func makeTree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// under joins slash-separated paths to root.
+func under(root string, paths ...string) []string {
+	joined := make([]string, len(paths))
+	for i, p := range paths {
+		joined[i] = filepath.Join(root, filepath.FromSlash(p))
+	}
+	return joined
+}
+
+func TestExpandPattern(t *testing.T) {
+	root := makeTree(t,
+		"a.txt",
+		"b.txt",
+		"c.log",
+		"logs/app.log",
+		"logs/old/app.log",
+		"sites/one/www/index.html",
+		"sites/two/www/index.html",
+		"sites/two/notes.txt",
+		"lit[1]/a.txt",
+		"star*/y.txt",
+	)
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.txt", []string{"a.txt", "b.txt"}},
+		{"?.log", []string{"c.log"}},
+		{"[ab].txt", []string{"a.txt", "b.txt"}},
+		{"*.md", []string{}},
+		{"sites/*/www", []string{"sites/one/www", "sites/two/www"}},
+		// Files can't contain anything
+		{"sites/two/*/index.html", []string{"sites/two/www/index.html"}},
+		{"logs/**/*.log", []string{"logs/app.log", "logs/old/app.log"}},
+		{"sites/**", []string{"sites", "sites/one", "sites/one/www", "sites/two", "sites/two/www"}},
+		// Names containing wildcards match themselves
+		{"lit[1]/*.txt", []string{"lit[1]/a.txt"}},
+		{"star*/y.txt", []string{"star*/y.txt"}},
+	}
+
+	for _, tt := range tests {
+		got, err := expandPattern(filepath.Join(root, filepath.FromSlash(tt.pattern)))
+		if err != nil {
+			t.Errorf("expandPattern(%q) returned %v", tt.pattern, err)
+		}
+		if want := under(root, tt.want...); !slices.Equal(got, want) {
+			t.Errorf("expandPattern(%q) = %v, want %v", tt.pattern, got, want)
+		}
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	root := makeTree(t, "etc/hosts", "srv/app/data", "srv/web/data", "[2024] Taxes/return.pdf")
+	paths := under(root, "etc/hosts", "srv/*/data", "missing", "var/*.log", "[2024] Taxes", "logs/[a-/*.log")
+
+	expanded, expansions, unmatched, invalid := expandPaths(paths)
+
+	// Plain paths are kept even if they don't exist, and existing ones are taken literally
+	want := under(root, "etc/hosts", "srv/app/data", "srv/web/data", "missing", "[2024] Taxes")
+	if !slices.Equal(expanded, want) {
+		t.Errorf("expanded = %v, want %v", expanded, want)
+	}
+	if len(expansions) != 1 || expansions[0].Pattern != paths[1] || len(expansions[0].Matches) != 2 {
+		t.Errorf("expansions = %+v, want the 2 matches of %q", expansions, paths[1])
+	}
+	if len(unmatched) != 1 || unmatched[0].Code != PatternNoMatch || unmatched[0].Source != paths[3] {
+		t.Errorf("unmatched = %+v, want %v for %q", unmatched, PatternNoMatch, paths[3])
+	}
+	if len(invalid) != 1 || invalid[0].Code != PathError || invalid[0].Source != paths[5] {
+		t.Errorf("invalid = %+v, want %v for %q", invalid, PathError, paths[5])
+	}
+}
+
+func TestPathHooks(t *testing.T) {
+	stop := []config.Command{config.NewCommand("docker stop app")}
+	entries := []config.PathEntry{
+		config.NewPathEntry("/etc"),
+		{Path: "/srv/*/data", Pre: stop},
+		{Path: "/var/lib/app", Post: stop},
+		config.NewPathEntry("/var/lib"),
+		{Path: "/srv/a/data/", Pre: stop},
+		{Path: "/opt/*/cache", Pre: stop},
+		config.NewPathEntry("/opt"),
+	}
+	expansions := []PatternExpansion{{Pattern: "/srv/*/data", Matches: []string{"/srv/a/data", "/srv/b/data"}}}
+	// What's left to transfer once nested paths and duplicates are dropped
+	paths := []string{"/etc", "/srv/a/data", "/srv/b/data", "/var/lib", "/opt"}
+
+	hooks := pathHooks(entries, expansions, paths)
+
+	want := map[string][]*config.PathEntry{
+		"/srv/a/data": {&entries[1], &entries[4]},
+		"/srv/b/data": {&entries[1]},
+		// Nested paths are transferred with the path containing them, and so are their commands
+		"/var/lib": {&entries[2]},
+	}
+	if !maps.EqualFunc(hooks, want, slices.Equal) {
+		t.Errorf("hooks = %v, want %v", hooks, want)
+	}
+}
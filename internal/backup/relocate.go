@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+)
+
+// PathMap relocates every path starting with From so that it starts with To instead.
+type PathMap struct {
+	From string
+	To   string
+}
+
+// ParsePathMap parses a relocation rule in the form '/old/prefix=/new/prefix'.
+func ParsePathMap(rule string) (PathMap, error) {
+	from, to, found := strings.Cut(rule, "=")
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+	if !found || from == "" || to == "" {
+		return PathMap{}, fmt.Errorf("invalid path mapping '%s': expected '/old/prefix=/new/prefix'", rule)
+	}
+	return PathMap{
+		From: filepath.Clean(from),
+		To:   filepath.Clean(to),
+	}, nil
+}
+
+// apply returns the relocated path and whether the rule matched it.
+func (m PathMap) apply(path string) (string, bool) {
+	if path == m.From {
+		return m.To, true
+	}
+	if !isSubPath(m.From, path) {
+		return path, false
+	}
+	rel, err := filepath.Rel(m.From, path)
+	if err != nil {
+		return path, false
+	}
+	return filepath.Join(m.To, rel), true
+}
+
+// getLocalPath returns where a configured path should be restored on this machine.
+// The most specific mapping rule matching the path is applied first, then the result
+// is placed under the target directory, if one was given.
+func (session *BackupSession) getLocalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	local := abs
+	longest := -1
+	for _, m := range session.Opts.PathMaps {
+		if relocated, ok := m.apply(abs); ok && len(m.From) > longest {
+			local = relocated
+			longest = len(m.From)
+		}
+	}
+
+	if session.Opts.Target != "" {
+		// Volume names can't be nested in another path: 'C:\Users' becomes '<target>\C\Users'
+		volume := filepath.VolumeName(local)
+		rest := local[len(volume):]
+		local = filepath.Join(session.Opts.Target, strings.TrimSuffix(volume, ":"), rest)
+	}
+
+	if local != abs {
+		logger.Debugf("Relocated path: '%s' ---> '%s'", abs, local)
+	}
+	return local, nil
+}
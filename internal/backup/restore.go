@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_filter "github.com/rclone/rclone/fs/filter"
+)
+
+// Restore transfers a single file or directory from the remote, if one of the configured paths covers it.
+// No commands are executed and nothing else is transferred.
+func (session *BackupSession) Restore(localPath string) error {
+	t0 := time.Now()
+
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+
+	covering := findCoveringPath(absPath, session.Machine.PathList())
+	if covering == "" {
+		logger.Info("Configured paths:")
+		for _, p := range session.Machine.PathList() {
+			logger.Infof("- %s", p)
+		}
+		return fmt.Errorf("'%s' is not covered by any configured path", absPath)
+	}
+	logger.Debugf("'%s' is covered by '%s'", absPath, covering)
+
+	if session.Opts.Simulate {
+		logger.Infof("Restore Simulation: '%s'", absPath)
+	} else {
+		logger.Infof("Restore Session: '%s'", absPath)
+	}
+
+	snapshot, err := session.selectSnapshot()
+	if err != nil {
+		status := getAbortStatus("SnapshotAbort", []BackupError{GenericError.Error("", err.Error())}, session.Opts.Language)
+		session.NotifyStatus(status, "red_circle", "package")
+		return err
+	}
+	if snapshot != nil {
+		logger.Infof("Restoring snapshot %s (%s)", snapshot.ID, snapshot.Time.Local().Format(time.DateTime))
+		session.snapshot = snapshot
+	}
+	session.paths = []string{absPath}
+
+	wg := sync.WaitGroup{}
+	errs := &ErrorList{}
+	wg.Add(1)
+	session.downloadPath(absPath, &wg, errs, session.Opts.Simulate)
+	failed := errs.Len() > 0
+
+	// No commands were executed
+	status, statusEmoji := session.getStatus(errs, &ErrorList{}, &ErrorList{})
+	session.NotifyStatus(status, statusEmoji, "package")
+	logger.Infof("ALL DONE! Time taken: %v\n", time.Since(t0))
+
+	if failed {
+		return fmt.Errorf("could not restore '%s'", absPath)
+	}
+	return nil
+}
+
+// findCoveringPath returns the most specific configured path that includes the given absolute path.
+func findCoveringPath(absPath string, paths []string) string {
+	covering := ""
+	longest := -1
+	for _, p := range paths {
+		candidate := p
+		if isPattern(p) {
+			prefix, rest := splitPattern(p)
+			prefixAbs, err := filepath.Abs(prefix)
+			if err != nil || !isSubPath(prefixAbs, absPath) {
+				continue
+			}
+			rel, err := filepath.Rel(prefixAbs, absPath)
+			if err != nil {
+				continue
+			}
+			fi, err := newPatternFilter(rest)
+			if err != nil || !fi.IncludeRemote(filepath.ToSlash(rel)) {
+				continue
+			}
+			candidate = prefixAbs
+		} else {
+			pAbs, err := filepath.Abs(p)
+			if err != nil || (pAbs != absPath && !isSubPath(pAbs, absPath)) {
+				continue
+			}
+			candidate = pAbs
+		}
+
+		if len(candidate) > longest {
+			covering = p
+			longest = len(candidate)
+		}
+	}
+	return covering
+}
+
+// newPatternFilter returns an rclone filter including whatever matches the pattern,
+// relative to its fixed part, along with the contents of matching directories.
+func newPatternFilter(pattern string) (*rc_filter.Filter, error) {
+	opt := rc_filter.DefaultOpt
+	opt.IncludeRule = []string{"/" + pattern, "/" + pattern + "/**"}
+	return rc_filter.NewFilter(&opt)
+}
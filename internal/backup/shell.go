@@ -0,0 +1,406 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	"github.com/0x07cf-dev/go-backup/internal/utils"
+)
+
+// shellSession runs commands one after the other in the same shell process, so that whatever they change
+// (working directory, variables, functions, options like 'set -e') carries over to the following ones.
+// After each command the shell prints a delimiter line with the exit code on stdout, and another
+// delimiter on stderr: everything before them is the command's output.
+type shellSession struct {
+	shell     string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    chan string
+	stderr    chan string
+	delimiter string
+	ended     bool
+	// The state of the shell, as the built-ins see it: every command of the session shares it
+	opts *CommandOpts
+}
+
+var errShellEnded = errors.New("the shell session has ended")
+
+func startShellSession(ctx context.Context, shell string, dir string, env []string, delimiter string) (*shellSession, error) {
+	cmd := exec.CommandContext(ctx, shell, "-s")
+	utils.KillProcessGroup(cmd)
+	cmd.Dir = dir
+	cmd.Env = env
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	session := &shellSession{
+		shell:     shell,
+		cmd:       cmd,
+		stdin:     stdin,
+		stdout:    make(chan string),
+		stderr:    make(chan string),
+		delimiter: delimiter,
+	}
+	go scanLines(stdout, session.stdout)
+	go scanLines(stderr, session.stderr)
+	return session, nil
+}
+
+func scanLines(r io.Reader, lines chan<- string) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines <- scanner.Text()
+	}
+	close(lines)
+}
+
+// run executes a script in the session, writing its output line by line as it comes, and returns its exit code.
+// If the shell exits, as 'set -e' makes it do on failures, the exit code is the shell's and the session ends.
+// If the context is done first, the shell is killed along with whatever it started.
+func (s *shellSession) run(ctx context.Context, script string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if s.ended {
+		return -1, errShellEnded
+	}
+
+	// An incomplete script would swallow the delimiters
+	if out, err := exec.Command(s.shell, "-n", "-c", script).CombinedOutput(); err != nil {
+		stderr.Write(out)
+		return 2, nil
+	}
+
+	// Commands can't read the session's own input
+	_, err := fmt.Fprintf(s.stdin, "{\n%s\n} </dev/null\n__gobackup_status=$?\nprintf '\\n%s %%d\\n' \"$__gobackup_status\"\nprintf '\\n%s\\n' >&2\n",
+		script, s.delimiter, s.delimiter)
+	if err != nil {
+		return -1, s.end()
+	}
+
+	code := -1
+	stdoutDone, stderrDone := false, false
+	stdoutLines, stderrLines := shellLines{w: stdout}, shellLines{w: stderr}
+	defer stdoutLines.end()
+	defer stderrLines.end()
+	for !stdoutDone || !stderrDone {
+		select {
+		case line, ok := <-s.stdout:
+			switch {
+			case !ok:
+				return s.exitCode(), s.end()
+			case strings.HasPrefix(line, s.delimiter+" "):
+				code, _ = strconv.Atoi(strings.TrimPrefix(line, s.delimiter+" "))
+				stdoutDone = true
+			default:
+				stdoutLines.write(line)
+			}
+		case line, ok := <-s.stderr:
+			switch {
+			case !ok:
+				stderrDone = true
+			case line == s.delimiter:
+				stderrDone = true
+			default:
+				stderrLines.write(line)
+			}
+		case <-ctx.Done():
+			s.cmd.Cancel()
+			s.end()
+			return -1, ctx.Err()
+		}
+	}
+	return code, nil
+}
+
+// shellLines writes the lines of a command as they are read. Empty lines are held back until another line
+// follows them, since the last one may have been printed before the delimiter.
+type shellLines struct {
+	w     io.Writer
+	empty int
+}
+
+func (l *shellLines) write(line string) {
+	if line == "" {
+		l.empty++
+		return
+	}
+	io.WriteString(l.w, strings.Repeat("\n", l.empty)+line+"\n")
+	l.empty = 0
+}
+
+func (l *shellLines) end() {
+	if l.empty > 1 {
+		io.WriteString(l.w, strings.Repeat("\n", l.empty-1))
+	}
+}
+
+// end marks the session as ended and reaps the shell.
+func (s *shellSession) end() error {
+	if !s.ended {
+		s.ended = true
+		s.stdin.Close()
+		// Nobody reads the output anymore
+		go func() {
+			for range s.stdout {
+			}
+		}()
+		go func() {
+			for range s.stderr {
+			}
+		}()
+		s.cmd.Wait()
+	}
+	return errShellEnded
+}
+
+func (s *shellSession) exitCode() int {
+	s.end()
+	if s.cmd.ProcessState == nil {
+		return -1
+	}
+	return s.cmd.ProcessState.ExitCode()
+}
+
+// Close lets the shell exit.
+func (s *shellSession) Close() {
+	s.end()
+}
+
+// sessionScript returns the script that runs a command in a shell session.
+// A command with its own directory or variables runs in a subshell, so that they only apply to it.
+func sessionScript(command config.Command) string {
+	var script strings.Builder
+	script.WriteString(command.Run)
+	for _, arg := range command.Args {
+		script.WriteString(" " + doubleQuote(arg))
+	}
+	if command.Dir == "" && len(command.Env) == 0 {
+		return script.String()
+	}
+
+	var sub strings.Builder
+	sub.WriteString("(\n")
+	if command.Dir != "" {
+		sub.WriteString("cd -- " + doubleQuote(command.Dir) + " || exit\n")
+	}
+	for _, kv := range command.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		sub.WriteString("export " + k + "=" + doubleQuote(v) + "\n")
+	}
+	sub.WriteString(script.String() + "\n)")
+	return sub.String()
+}
+
+// doubleQuote quotes a word for POSIX shells, still allowing variables to be expanded.
+func doubleQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
+
+// usesShellSession reports whether the commands of a phase run in a persistent shell.
+func (session *BackupSession) usesShellSession(phase string) bool {
+	mode := session.Machine.PersistentShell
+	switch mode {
+	case "":
+		return false
+	case config.PersistentShellPre, config.PersistentShellPost, config.PersistentShellAll:
+		if mode != phase && mode != config.PersistentShellAll {
+			return false
+		}
+	default:
+		logger.Warnf("Unknown value for persistent_shell: '%s' (expected '%s', '%s' or '%s')", session.Machine.PersistentShell,
+			config.PersistentShellPre, config.PersistentShellPost, config.PersistentShellAll)
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		logger.Warn("Persistent shells are not supported on Windows: commands will run separately.")
+		return false
+	}
+	return true
+}
+
+// executeInShell runs a command in the phase's shell session.
+func (session *BackupSession) executeInShell(shell *shellSession, errs *ErrorList, ordinal int, command config.Command, phase string) cmdResult {
+	name := command.String()
+	if command.Run == "" {
+		errs.Add(CmdInvalid.Error(name, "'run' is required"))
+		return cmdFailed
+	}
+
+	// Commands chosen to fail are not executed
+	if fault, ok := session.faults.forCommand(name); ok {
+		errs.Add(fault)
+		return cmdFailed
+	}
+
+	output := session.Machine.ShowsOutput()
+	if command.Output != nil {
+		output = *command.Output
+	}
+
+	timeout, err := session.commandTimeout(command)
+	if err != nil {
+		errs.Add(CmdInvalid.Error(name, err.Error()))
+		return cmdFailed
+	}
+	ctx, cancel := session.commandContext(shell.opts, timeout)
+	defer cancel()
+
+	// Built-ins are dispatched before the shell, which doesn't know them. Those changing the state
+	// of the commands have an equivalent in the shell, which runs it instead: the built-ins running
+	// afterwards then see its effect.
+	if builtin, ok := shellBuiltin(command); ok {
+		if !shellEquivalents[builtin] {
+			return session.executeBuiltinInShell(ctx, shell, errs, ordinal, builtin, command.Run)
+		}
+		defer session.syncShellState(ctx, shell)
+	}
+
+	addSecretVars(command.Env)
+	stdout, stderr := session.outputWriters(phase, ordinal, output)
+	code, err := shell.run(ctx, sessionScript(command), stdout, stderr)
+	stdout.Close()
+	stderr.Close()
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Errorf("%d° (%s): timed out after %s", ordinal, name, timeout)
+		errs.Add(CmdTimeout.Error(name, timeout.String()))
+		return cmdFailed
+	}
+	if err != nil && code < 0 {
+		logger.Errorf("%d° (%s): '%s'", ordinal, name, err)
+		errs.Add(CmdFailed.Error(name, err.Error()))
+		return cmdFailed
+	}
+	if err != nil {
+		logger.Warnf("%d° (%s): the shell exited, the following commands will not be executed", ordinal, name)
+	}
+	if code >= 0 && session.acceptsExitCode(ordinal, command, code, stderr.String()) {
+		return cmdSucceeded
+	}
+	if code >= 0 && asksToSkip(phase, command, code) {
+		return cmdSkipRun
+	}
+	if code != 0 {
+		message := stderr.String()
+		if message == "" {
+			message = fmt.Sprintf("exit status %d", code)
+		}
+		logger.Errorf("%d° (%s): 'exit status %d'", ordinal, name, code)
+		errs.Add(CmdFailed.Error(name, message))
+		return cmdFailed
+	}
+	return cmdSucceeded
+}
+
+// Built-ins with an equivalent in the shell, which runs in their place
+var shellEquivalents = map[string]bool{
+	"cd":     true,
+	"pushd":  true,
+	"popd":   true,
+	"export": true,
+	"unset":  true,
+}
+
+// shellBuiltin returns the name of the built-in a command runs in a shell session. Only a plain string
+// with nothing the shell would interpret, like '&&' or a pipe, runs a built-in: anything else is a script.
+func shellBuiltin(command config.Command) (string, bool) {
+	if !command.Plain() || strings.ContainsAny(command.Run, "&|;<>()`\n") {
+		return "", false
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(command.Run), " ")
+	if _, ok := Builtin(name); !ok {
+		return "", false
+	}
+	return name, true
+}
+
+// executeBuiltinInShell runs a built-in command from the current directory and with the variables of a shell session.
+func (session *BackupSession) executeBuiltinInShell(ctx context.Context, shell *shellSession, errs *ErrorList, ordinal int, name string, command string) cmdResult {
+	if err := session.syncShellState(ctx, shell); err != nil {
+		logger.Errorf("%d° (%s): '%s'", ordinal, command, err)
+		errs.Add(CmdFailed.Error(command, err.Error()))
+		return cmdFailed
+	}
+
+	cmdFunc, _ := Builtin(name)
+	errsBefore := errs.Len()
+	output := cmdFunc(ctx, errs, command)
+	if errs.Len() > errsBefore {
+		logger.Errorf("%d° (%s): '%s'", ordinal, command, output)
+		return cmdFailed
+	}
+	logger.Infof("%d° (%s): '%s'", ordinal, command, output)
+	return cmdSucceeded
+}
+
+// Prints the directory and the exported variables of a shell, each followed by a NUL character
+const shellStateScript = `printf '%s\0' "$PWD"
+for __gobackup_var in $(compgen -e); do printf '%s=%s\0' "$__gobackup_var" "${!__gobackup_var}"; done
+unset __gobackup_var`
+
+// syncShellState makes the built-ins use the current directory and the variables of a shell session,
+// which its commands may have changed.
+func (session *BackupSession) syncShellState(ctx context.Context, shell *shellSession) error {
+	var stdout, stderr strings.Builder
+	code, err := shell.run(ctx, shellStateScript, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("could not read the state of the shell: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	fields := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\x00")
+	cwd, env := fields[0], []string{}
+	for _, kv := range fields[1:] {
+		if kv != "" {
+			env = append(env, kv)
+		}
+	}
+	// Only variables the commands set can be new secrets
+	_, current := shell.opts.get()
+	addSecretVars(slices.DeleteFunc(slices.Clone(env), func(kv string) bool { return slices.Contains(current, kv) }))
+	shell.opts.setState(cwd, env)
+	return nil
+}
+
+// newShellSession starts the shell session of a phase, if it uses one, from the given state.
+func (session *BackupSession) newShellSession(phase string, opts *CommandOpts) *shellSession {
+	if !session.usesShellSession(phase) {
+		return nil
+	}
+	delimiter := fmt.Sprintf("__GOBACKUP_%s_%d__", session.runID, time.Now().UnixNano())
+	cwd, env := opts.get()
+	shell, err := startShellSession(session.context, utils.DefaultShell, cwd, env, delimiter)
+	if err != nil {
+		logger.Errorf("Error starting the shell session: %s (commands will run separately)", err)
+		return nil
+	}
+	shell.opts = opts
+	logger.Debugf("Started %s session for %s commands", utils.DefaultShell, phase)
+	return shell
+}
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/utils"
+)
+
+func startTestShell(t *testing.T) *shellSession {
+	t.Helper()
+	if _, err := exec.LookPath(utils.DefaultShell); err != nil {
+		t.Skipf("%s is not available", utils.DefaultShell)
+	}
+	shell, err := startShellSession(context.Background(), utils.DefaultShell, t.TempDir(), os.Environ(), "__GOBACKUP_TEST__")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(shell.Close)
+	return shell
+}
+
+// runScript runs a script in the session, returning its exit code and output.
+func runScript(ctx context.Context, shell *shellSession, script string) (int, string, string, error) {
+	var stdout, stderr strings.Builder
+	code, err := shell.run(ctx, script, &stdout, &stderr)
+	return code, stdout.String(), stderr.String(), err
+}
+
+func TestShellSessionKeepsState(t *testing.T) {
+	shell := startTestShell(t)
+	dir := t.TempDir()
+
+	steps := []struct {
+		script     string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{"cd '" + dir + "' && export NAME=world", 0, "", ""},
+		{`echo "hello $NAME from $PWD"`, 0, "hello world from " + dir + "\n", ""},
+		{"greet() { echo hi $1; }", 0, "", ""},
+		{"greet there; echo oops >&2; false", 1, "hi there\n", "oops\n"},
+		// Output without a final line break is kept apart from the delimiter
+		{"printf 'no newline'", 0, "no newline\n", ""},
+		{"(exit 75)", 75, "", ""},
+	}
+
+	for _, step := range steps {
+		code, stdout, stderr, err := runScript(context.Background(), shell, step.script)
+		if err != nil {
+			t.Fatalf("run(%q): %v", step.script, err)
+		}
+		if code != step.wantCode || stdout != step.wantStdout || stderr != step.wantStderr {
+			t.Errorf("run(%q) = %d, %q, %q, want %d, %q, %q",
+				step.script, code, stdout, stderr, step.wantCode, step.wantStdout, step.wantStderr)
+		}
+	}
+}
+
+func TestShellSessionSyntaxError(t *testing.T) {
+	shell := startTestShell(t)
+
+	// An unterminated quote must not swallow the delimiters
+	code, _, stderr, err := runScript(context.Background(), shell, "echo 'oops")
+	if err != nil || code != 2 || stderr == "" {
+		t.Errorf("run() = %d, %q, %v, want a syntax error", code, stderr, err)
+	}
+	if code, stdout, _, err := runScript(context.Background(), shell, "echo still here"); err != nil || code != 0 || stdout != "still here\n" {
+		t.Errorf("the session didn't survive a syntax error: %d, %q, %v", code, stdout, err)
+	}
+}
+
+func TestShellSessionEnds(t *testing.T) {
+	shell := startTestShell(t)
+
+	code, _, _, err := runScript(context.Background(), shell, "set -e; false; echo unreachable")
+	if err != errShellEnded || code != 1 {
+		t.Errorf("run() = %d, %v, want the shell's exit code and %v", code, err, errShellEnded)
+	}
+	if _, _, _, err := runScript(context.Background(), shell, "true"); err != errShellEnded {
+		t.Errorf("run() after the shell exited: %v, want %v", err, errShellEnded)
+	}
+}
+
+func TestShellSessionTimeout(t *testing.T) {
+	shell := startTestShell(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, _, err := runScript(ctx, shell, "sleep 10"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timing out took %s", elapsed)
+	}
+}
+
+func TestSessionScript(t *testing.T) {
+	tests := []struct {
+		command config.Command
+		want    string
+	}{
+		{config.Command{Run: "echo $HOME"}, "echo $HOME"},
+		{config.Command{Run: "tar", Args: []string{"czf", "my files.tgz", `"quoted"`}}, `tar "czf" "my files.tgz" "\"quoted\""`},
+		{
+			config.Command{Run: "make", Dir: "/src/app", Env: []string{"CC=clang", "FLAGS=-O2 -g"}},
+			"(\ncd -- \"/src/app\" || exit\nexport CC=\"clang\"\nexport FLAGS=\"-O2 -g\"\nmake\n)",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sessionScript(tt.command); got != tt.want {
+			t.Errorf("sessionScript(%+v) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	slashpath "path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+	"github.com/0x07cf-dev/go-backup/internal/logger"
+	rc_fs "github.com/rclone/rclone/fs"
+	rc_filter "github.com/rclone/rclone/fs/filter"
+	rc_fspath "github.com/rclone/rclone/fs/fspath"
+	rc_ops "github.com/rclone/rclone/fs/operations"
+	rc_walk "github.com/rclone/rclone/fs/walk"
+)
+
+// Every upload run is recorded on the remote, next to the machine's files:
+//
+//	<Root>/<Hostname>/.go-backup/snapshots/<ID>.json   the files present on the remote after the run
+//	<Root>/<Hostname>/.go-backup/versions/<ID>/...     the files the run overwrote, as they were before
+//
+// Together, they allow restoring the state of any past run. Jobs keep theirs apart, under
+// <Root>/<Hostname>/.go-backup/jobs/<Job>/, since each of them only covers some paths.
+const (
+	metaDir          = ".go-backup"
+	jobsDir          = "jobs"
+	snapshotsDir     = "snapshots"
+	versionsDir      = "versions"
+	snapshotIDFormat = "20060102T150405.000000000Z"
+	// Parses IDs with or without a fraction of a second, which those recorded by older versions lack
+	snapshotIDLayout = "20060102T150405Z"
+)
+
+// Snapshot describes the files on the remote at the end of an upload run.
+// Files are keyed by their path relative to the machine's directory on the remote.
+type Snapshot struct {
+	ID       string                  `json:"id"`
+	Time     time.Time               `json:"time"`
+	Hostname string                  `json:"hostname"`
+	Paths    []string                `json:"paths"`
+	Files    map[string]SnapshotFile `json:"files"`
+}
+
+type SnapshotFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// newRunID returns the ID of a run started at the given time. Runs started within the same second
+// get different IDs, so that none overwrites the snapshot of another.
+func newRunID(t time.Time) string {
+	return t.UTC().Format(snapshotIDFormat)
+}
+
+// runTime returns when the run with the given ID started.
+func runTime(id string) (time.Time, error) {
+	return time.Parse(snapshotIDLayout, id)
+}
+
+// compareRunIDs orders run IDs by the time the runs started.
+func compareRunIDs(a string, b string) int {
+	ta, _ := runTime(a)
+	tb, _ := runTime(b)
+	return ta.Compare(tb)
+}
+
+// ParsePointInTime parses the moment to restore, expressed in local time.
+func ParsePointInTime(s string) (time.Time, error) {
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid point in time '%s': expected a format like 2006-01-02T15:04", s)
+}
+
+// getMetaPath returns the remote path of go-backup's own files for this machine.
+func (session *BackupSession) getMetaPath(elem ...string) (string, error) {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return "", err
+	}
+	dir := []string{metaDir}
+	if session.Opts.Job != "" {
+		dir = append(dir, jobsDir, session.Opts.Job)
+	}
+	return rc_fspath.JoinRootPath(root, slashpath.Join(append(dir, elem...)...)), nil
+}
+
+// getVersionsPath returns where files overwritten by this run are kept, for the given configured path.
+func (session *BackupSession) getVersionsPath(absPath string) (string, error) {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return "", err
+	}
+	remotePath, err := session.getRemotePath(absPath)
+	if err != nil {
+		return "", err
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(remotePath, root), "/")
+	return session.getMetaPath(versionsDir, session.runID, rel)
+}
+
+// isMetaPath reports whether a path relative to the machine's directory on the remote is one of go-backup's own files.
+func isMetaPath(rel string) bool {
+	return rel == metaDir || strings.HasPrefix(rel, metaDir+"/")
+}
+
+// metaRel returns where go-backup's own files are relative to a remote directory, if they're inside it.
+// That's the case for the directory of a configured path like '/', which is the machine's directory itself.
+func (session *BackupSession) metaRel(remotePath string) (string, bool) {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return "", false
+	}
+	meta := rc_fspath.JoinRootPath(root, metaDir)
+	dir := strings.TrimSuffix(remotePath, "/")
+	if !strings.HasPrefix(meta, dir+"/") {
+		return "", false
+	}
+	return meta[len(dir)+1:], true
+}
+
+// excludeMeta returns a context in which transfers to or from remotePath leave go-backup's own files alone.
+// Otherwise a path like '/' would overwrite them, or have its previous versions kept inside itself.
+func (session *BackupSession) excludeMeta(ctx context.Context, remotePath string) (context.Context, error) {
+	rel, ok := session.metaRel(remotePath)
+	if !ok {
+		return ctx, nil
+	}
+
+	// Rules apply in order, so the exclusion comes before anything the context already includes
+	opt := rc_filter.GetConfig(ctx).Opt
+	rules := []string{"- /" + rel + "/**"}
+	for _, rule := range opt.IncludeRule {
+		rules = append(rules, "+ "+rule)
+	}
+	for _, rule := range opt.ExcludeRule {
+		rules = append(rules, "- "+rule)
+	}
+	rules = append(rules, opt.FilterRule...)
+	if len(opt.IncludeRule) > 0 {
+		rules = append(rules, "- /**")
+	}
+	opt.IncludeRule, opt.ExcludeRule, opt.FilterRule = nil, nil, rules
+
+	fi, err := rc_filter.NewFilter(&opt)
+	if err != nil {
+		return nil, err
+	}
+	return rc_filter.ReplaceConfig(ctx, fi), nil
+}
+
+// withVersioning returns a context in which files overwritten on destFs are moved to this run's versions.
+func (session *BackupSession) withVersioning(ctx context.Context, destFs rc_fs.Fs, absPath string) context.Context {
+	if !rc_ops.CanServerSideMove(destFs) {
+		logger.Warnf("Remote can't move files: previous versions of '%s' will not be kept", absPath)
+		return ctx
+	}
+	versionsPath, err := session.getVersionsPath(absPath)
+	if err != nil {
+		logger.Warnf("Previous versions of '%s' will not be kept: %s", absPath, err)
+		return ctx
+	}
+	ctx, ci := rc_fs.AddConfig(ctx)
+	ci.BackupDir = versionsPath
+	return ctx
+}
+
+// writeSnapshot records the files currently on the remote for every transferred path.
+func (session *BackupSession) writeSnapshot() error {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return err
+	}
+	rootFs, err := rc_fs.NewFs(session.context, root)
+	if err != nil {
+		return err
+	}
+
+	snapshot := Snapshot{
+		ID:       session.runID,
+		Time:     session.started,
+		Hostname: session.Machine.Hostname,
+		Paths:    session.paths,
+		Files:    make(map[string]SnapshotFile),
+	}
+
+	for _, path := range session.paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		remotePath, err := session.getRemotePath(absPath)
+		if err != nil {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(remotePath, root), "/")
+
+		// A single file
+		if obj, err := rootFs.NewObject(session.context, rel); err == nil {
+			snapshot.Files[rel] = SnapshotFile{Size: obj.Size(), ModTime: obj.ModTime(session.context)}
+			continue
+		}
+
+		err = rc_walk.ListR(session.context, rootFs, rel, true, -1, rc_walk.ListObjects, func(entries rc_fs.DirEntries) error {
+			entries.ForObject(func(obj rc_fs.Object) {
+				if isMetaPath(obj.Remote()) {
+					return
+				}
+				snapshot.Files[obj.Remote()] = SnapshotFile{Size: obj.Size(), ModTime: obj.ModTime(session.context)}
+			})
+			return nil
+		})
+		if err != nil && !errors.Is(err, rc_fs.ErrorDirNotFound) {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	snapshotsPath, err := session.getMetaPath(snapshotsDir)
+	if err != nil {
+		return err
+	}
+	snapshotsFs, err := initFs(session.context, snapshotsPath)
+	if err != nil {
+		return err
+	}
+	_, err = rc_ops.Rcat(session.context, snapshotsFs, snapshot.ID+".json", io.NopCloser(bytes.NewReader(data)), snapshot.Time, nil)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Snapshot recorded: %s (%d files)", snapshot.ID, len(snapshot.Files))
+	return nil
+}
+
+// keptSnapshots returns the snapshots the retention keeps, out of those given from the oldest to the latest,
+// which is always kept.
+func keptSnapshots(ids []string, retention *config.Retention, now time.Time) ([]string, error) {
+	keep := ids
+	if retention.Snapshots > 0 && len(keep) > retention.Snapshots {
+		keep = keep[len(keep)-retention.Snapshots:]
+	}
+	if retention.MaxAge != "" {
+		maxAge, err := time.ParseDuration(retention.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention max_age '%s': %s", retention.MaxAge, err)
+		}
+		oldest := now.Add(-maxAge)
+		for len(keep) > 1 {
+			if t, _ := runTime(keep[0]); !t.Before(oldest) {
+				break
+			}
+			keep = keep[1:]
+		}
+	}
+	return keep, nil
+}
+
+// pruneSnapshots deletes the snapshots the retention doesn't keep, along with the versions only they needed.
+// The latest snapshot is always kept.
+func (session *BackupSession) pruneSnapshots() error {
+	retention := session.Machine.Retention
+	if retention == nil || (retention.Snapshots <= 0 && retention.MaxAge == "") {
+		return nil
+	}
+
+	ids, err := session.ListSnapshots()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	keep, err := keptSnapshots(ids, retention, time.Now())
+	if err != nil {
+		return err
+	}
+	pruned := ids[:len(ids)-len(keep)]
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	snapshotsPath, err := session.getMetaPath(snapshotsDir)
+	if err != nil {
+		return err
+	}
+	snapshotsFs, err := rc_fs.NewFs(session.context, snapshotsPath)
+	if err != nil {
+		return err
+	}
+	for _, id := range pruned {
+		obj, err := snapshotsFs.NewObject(session.context, id+".json")
+		if err != nil {
+			return err
+		}
+		if err := rc_ops.DeleteFile(session.context, obj); err != nil {
+			return err
+		}
+		logger.Infof("Snapshot deleted: %s", id)
+	}
+
+	// Versions overwritten by a run are only needed to restore the snapshots before it
+	versionIDs, err := session.listMetaIDs(versionsDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range versionIDs {
+		if compareRunIDs(id, keep[0]) > 0 {
+			break
+		}
+		versionsPath, err := session.getMetaPath(versionsDir, id)
+		if err != nil {
+			return err
+		}
+		versionsFs, err := rc_fs.NewFs(session.context, versionsPath)
+		if err != nil {
+			return err
+		}
+		if err := rc_ops.Purge(session.context, versionsFs, ""); err != nil {
+			return err
+		}
+		logger.Debugf("Previous versions deleted: %s", id)
+	}
+	return nil
+}
+
+// listMetaIDs returns the sorted run IDs found in one of go-backup's directories on the remote.
+func (session *BackupSession) listMetaIDs(dir string) ([]string, error) {
+	dirPath, err := session.getMetaPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirFs, err := rc_fs.NewFs(session.context, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := dirFs.List(session.context, "")
+	if errors.Is(err, rc_fs.ErrorDirNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		id := strings.TrimSuffix(slashpath.Base(entry.Remote()), ".json")
+		if _, err := runTime(id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, compareRunIDs)
+	return ids, nil
+}
+
+// ListSnapshots returns the IDs of the snapshots available on the remote, oldest first.
+func (session *BackupSession) ListSnapshots() ([]string, error) {
+	return session.listMetaIDs(snapshotsDir)
+}
+
+func (session *BackupSession) loadSnapshot(id string) (*Snapshot, error) {
+	snapshotsPath, err := session.getMetaPath(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshotsFs, err := rc_fs.NewFs(session.context, snapshotsPath)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := snapshotsFs.NewObject(session.context, id+".json")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := obj.Open(session.context)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", id, err)
+	}
+	return &snapshot, nil
+}
+
+// selectSnapshot finds the snapshot requested by ID or point in time, if any was requested.
+func (session *BackupSession) selectSnapshot() (*Snapshot, error) {
+	if session.Opts.Snapshot == "" && session.Opts.At.IsZero() {
+		return nil, nil
+	}
+
+	ids, err := session.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := ""
+	if session.Opts.Snapshot != "" {
+		for _, id := range ids {
+			if id == session.Opts.Snapshot {
+				selected = id
+			}
+		}
+	} else {
+		// Most recent run that started before the requested time
+		for _, id := range ids {
+			if t, _ := runTime(id); !t.After(session.Opts.At) {
+				selected = id
+			}
+		}
+	}
+
+	if selected == "" {
+		logger.Error("The requested snapshot doesn't exist.")
+		if len(ids) == 0 {
+			logger.Info("There are no snapshots on the remote for this machine.")
+		} else {
+			logger.Info("Available snapshots:")
+			for _, id := range ids {
+				t, _ := runTime(id)
+				logger.Infof("- %s (%s)", id, t.Local().Format(time.DateTime))
+			}
+		}
+		return nil, fmt.Errorf("snapshot not found")
+	}
+	return session.loadSnapshot(selected)
+}
+
+// restoreSnapshotPath restores the files of a configured path as they were in the session's snapshot.
+// Files overwritten by later runs are taken from the first of those runs' versions; the others are still current.
+func (session *BackupSession) restoreSnapshotPath(ctx context.Context, absPath string, localPath string, simulate bool) error {
+	root, err := session.getRemotePath("")
+	if err != nil {
+		return err
+	}
+	remotePath, err := session.getRemotePath(absPath)
+	if err != nil {
+		return err
+	}
+	prefix := strings.TrimPrefix(strings.TrimPrefix(remotePath, root), "/")
+
+	// Files of the snapshot that belong to this path
+	fi := rc_filter.GetConfig(ctx)
+	files := make(map[string]string)
+	for name := range session.snapshot.Files {
+		if name == prefix {
+			files[name] = localPath
+			continue
+		}
+		// The machine's whole directory, for '/'
+		rel := name
+		if prefix != "" {
+			rel = strings.TrimPrefix(name, prefix+"/")
+			if rel == name {
+				continue
+			}
+		}
+		if !fi.IncludeRemote(rel) {
+			continue
+		}
+		files[name] = filepath.Join(localPath, filepath.FromSlash(rel))
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("not found in snapshot %s", session.snapshot.ID)
+	}
+
+	// Where each file can be found
+	sources := make(map[string]string)
+	versionIDs, err := session.listMetaIDs(versionsDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range versionIDs {
+		if compareRunIDs(id, session.snapshot.ID) <= 0 {
+			continue
+		}
+		versionsPath, err := session.getMetaPath(versionsDir, id)
+		if err != nil {
+			return err
+		}
+		versionsFs, err := rc_fs.NewFs(ctx, versionsPath)
+		if err != nil {
+			return err
+		}
+		found := func(obj rc_fs.Object) {
+			if _, ok := files[obj.Remote()]; ok {
+				if _, seen := sources[obj.Remote()]; !seen {
+					sources[obj.Remote()] = versionsPath
+				}
+			}
+		}
+
+		// A single file
+		if obj, err := versionsFs.NewObject(ctx, prefix); err == nil {
+			found(obj)
+			continue
+		}
+		err = rc_walk.ListR(ctx, versionsFs, prefix, true, -1, rc_walk.ListObjects, func(entries rc_fs.DirEntries) error {
+			entries.ForObject(found)
+			return nil
+		})
+		if err != nil && !errors.Is(err, rc_fs.ErrorDirNotFound) {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	srcCache := make(map[string]rc_fs.Fs)
+	for _, name := range names {
+		srcPath, ok := sources[name]
+		if !ok {
+			srcPath = root
+		}
+		dest := files[name]
+
+		if simulate {
+			logger.Infof("  '%s' ---> '%s' (%s)", rc_fspath.JoinRootPath(srcPath, name), dest, rc_fs.SizeSuffix(session.snapshot.Files[name].Size))
+			continue
+		}
+
+		srcFs, ok := srcCache[srcPath]
+		if !ok {
+			if srcFs, err = rc_fs.NewFs(ctx, srcPath); err != nil {
+				return err
+			}
+			srcCache[srcPath] = srcFs
+		}
+		destFs, err := initFs(ctx, filepath.Dir(dest))
+		if err != nil {
+			return err
+		}
+		if err := rc_ops.CopyFile(ctx, destFs, srcFs, filepath.Base(dest), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/config"
+)
+
+func TestKeptSnapshots(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) string {
+		return newRunID(now.Add(-d))
+	}
+	day := 24 * time.Hour
+	ids := []string{ago(30 * day), ago(10 * day), ago(3 * day), ago(2 * time.Hour), ago(time.Hour)}
+
+	tests := []struct {
+		name      string
+		ids       []string
+		retention config.Retention
+		want      []string
+		wantErr   bool
+	}{
+		{"no limits", ids, config.Retention{}, ids, false},
+		{"fewer snapshots than the limit", ids, config.Retention{Snapshots: 10}, ids, false},
+		{"as many snapshots as the limit", ids, config.Retention{Snapshots: 5}, ids, false},
+		{"latest snapshots", ids, config.Retention{Snapshots: 2}, ids[3:], false},
+		{"only the latest", ids, config.Retention{Snapshots: 1}, ids[4:], false},
+		{"max age", ids, config.Retention{MaxAge: "168h"}, ids[2:], false},
+		{"max age keeping everything", ids, config.Retention{MaxAge: "1000h"}, ids, false},
+		{"max age keeps the latest anyway", ids, config.Retention{MaxAge: "30m"}, ids[4:], false},
+		{"max age and snapshots, max age wins", ids, config.Retention{Snapshots: 4, MaxAge: "168h"}, ids[2:], false},
+		{"max age and snapshots, snapshots win", ids, config.Retention{Snapshots: 2, MaxAge: "168h"}, ids[3:], false},
+		{"single old snapshot", ids[:1], config.Retention{Snapshots: 3, MaxAge: "1h"}, ids[:1], false},
+		{"invalid max age", ids, config.Retention{MaxAge: "a week"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keptSnapshots(tt.ids, &tt.retention, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("keptSnapshots() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("keptSnapshots(): %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("keptSnapshots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunIDs(t *testing.T) {
+	started := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	first, second := newRunID(started.Add(100*time.Millisecond)), newRunID(started.Add(600*time.Millisecond))
+	if first == second {
+		t.Fatalf("runs started in the same second have the same ID %s", first)
+	}
+
+	// IDs of older versions have no fraction of a second
+	old := "20240630T120000Z"
+	ids := []string{second, newRunID(started.Add(-time.Second)), first, old}
+	slices.SortFunc(ids, compareRunIDs)
+	want := []string{"20240630T115959.000000000Z", old, first, second}
+	if !slices.Equal(ids, want) {
+		t.Errorf("sorted IDs = %v, want %v", ids, want)
+	}
+
+	for _, id := range want {
+		if _, err := runTime(id); err != nil {
+			t.Errorf("runTime(%s): %v", id, err)
+		}
+	}
+	if got, _ := runTime(second); !got.Equal(started.Add(600 * time.Millisecond)) {
+		t.Errorf("runTime(%s) = %s", second, got)
+	}
+}
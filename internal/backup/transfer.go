@@ -3,19 +3,20 @@ package backup
 import (
 	"context"
 	"errors"
-	"math/rand"
 	"os"
+	slashpath "path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/0x07cf-dev/go-backup/internal/logger"
 	rc_fs "github.com/rclone/rclone/fs"
+	rc_filter "github.com/rclone/rclone/fs/filter"
 	rc_fspath "github.com/rclone/rclone/fs/fspath"
 	rc_ops "github.com/rclone/rclone/fs/operations"
 	rc_sync "github.com/rclone/rclone/fs/sync"
+	rc_walk "github.com/rclone/rclone/fs/walk"
 )
 
 func initFs(ctx context.Context, path string) (rc_fs.Fs, error) {
@@ -29,12 +30,27 @@ func initFs(ctx context.Context, path string) (rc_fs.Fs, error) {
 		if err = rc_ops.Mkdir(ctx, newFs, ""); err != nil {
 			return nil, err
 		}
-		logger.Infof("Created dir on remote: '%s'", path)
+		if rc_fs.GetConfig(ctx).DryRun {
+			logger.Infof("Would create dir on remote: '%s'", path)
+		} else {
+			logger.Infof("Created dir on remote: '%s'", path)
+		}
 	}
 	return newFs, nil
 }
 
-func (session *BackupSession) uploadPath(path string, wg *sync.WaitGroup, errCh chan BackupError, simulate bool) {
+// recordTransfer counts the transfer of a path, and keeps its errors apart: their source may be a file
+// under the path, or the fixed part of a pattern, which couldn't be traced back to it later.
+// It must be called with the session's lock held.
+func (session *BackupSession) recordTransfer(path string, errs *ErrorList, transfers *ErrorList) {
+	transfers.Attempt(errs)
+	if session.pathErrs == nil {
+		session.pathErrs = make(map[string][]BackupError)
+	}
+	session.pathErrs[path] = append(session.pathErrs[path], errs.Errors()...)
+}
+
+func (session *BackupSession) uploadPath(path string, wg *sync.WaitGroup, transfers *ErrorList, simulate bool) {
 	defer wg.Done()
 
 	// Mutex lock
@@ -46,49 +62,43 @@ func (session *BackupSession) uploadPath(path string, wg *sync.WaitGroup, errCh
 	}
 	session.processed[path] = true
 
-	if simulate {
-		// totally valid human-readable errors
-		errorChance := 0
-		if rand.Float32() < float32(errorChance) {
-			var syllables []string
-			vowels := []rune{'a', 'e', 'i', 'o', 'u'}
-			consonants := []rune{'b', 'c', 'd', 'f', 'g', 'h', 'j', 'k', 'l', 'm', 'n', 'p', 'q', 'r', 's', 't', 'v', 'w', 'x', 'y', 'z'}
-
-			for _, c := range consonants {
-				for _, v := range vowels {
-					syllables = append(syllables, string(c)+string(v))
-				}
-			}
+	// The path counts as a single transfer, however many errors it reports
+	errs := &ErrorList{}
+	defer session.recordTransfer(path, errs, transfers)
 
-			randomString := ""
-			for i := 0; i < 12; i++ {
-				randomString += syllables[rand.Intn(len(syllables))]
-				if rand.Intn(3) == 0 {
-					randomString += " "
-				}
-			}
+	// Paths chosen to fail are not transferred
+	if fault, ok := session.faults.forPath(path); ok {
+		errs.Add(fault)
+		return
+	}
 
-			logger.Infof("Simulating error: '%s'", path)
-			simulation := []BackupErrorCode{GenericError, UploadError}
-			rnd := (rand.Intn(len(simulation)) * rand.Intn(len(simulation))) % len(simulation)
-			errCh <- simulation[rnd].Error(path, randomString)
+	// Commands of this path, and of the paths it contains, run right before and after its transfer
+	for _, entry := range session.hooks[path] {
+		defer session.executePathHooks(path, entry.Post, phasePost, errs)
+		if !session.executePathHooks(path, entry.Pre, phasePre, errs) {
 			return
 		}
 	}
 
+	// Simulations walk the real trees without writing anything
+	ctx := session.context
+	if simulate {
+		ctx = withDryRun(ctx, path)
+	}
+
 	currFile, err := os.Stat(path)
 	if err != nil {
-		errCh <- PathError.Error(path, err.Error())
+		errs.Add(PathError.Error(path, err.Error()))
 		return
 	}
 	absPath, err := filepath.Abs(path)
 	if err != nil {
-		errCh <- PathError.Error(path, err.Error())
+		errs.Add(PathError.Error(path, err.Error()))
 		return
 	}
 	parent, _, err := rc_fspath.Split(path)
 	if err != nil {
-		errCh <- PathError.Error(path, err.Error())
+		errs.Add(PathError.Error(path, err.Error()))
 		return
 	}
 
@@ -97,81 +107,230 @@ func (session *BackupSession) uploadPath(path string, wg *sync.WaitGroup, errCh
 		// Upload directory to remote
 		remotePath, err := session.getRemotePath(absPath)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
+			return
+		}
+
+		// Go-backup's own files may be inside the destination
+		ctx, err := session.excludeMeta(ctx, remotePath)
+		if err != nil {
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
 
 		// Destination and source filesystems
-		destFs, err := initFs(session.context, remotePath)
+		destFs, err := initFs(ctx, remotePath)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
-		srcFs, err := initFs(session.context, absPath)
+		srcFs, err := initFs(ctx, absPath)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
 
-		// Upload
-		if !simulate {
-			if err = rc_sync.CopyDir(session.context,
-				destFs, // Upload dir destination: remoteRoot/hostname/sourceFileName.any
-				srcFs,  // Upload dir source: user-defined
-				true,   // Upload empty source dirs?
-			); err != nil {
-				errCh <- UploadError.Error(path, err.Error())
-				return
-			} else {
-				logger.Infof("Upload dir: '%s' ---> '%s'", path, remotePath)
-			}
+		// Upload, keeping the files that get overwritten
+		err = rc_sync.CopyDir(session.withVersioning(ctx, destFs, absPath),
+			destFs, // Upload dir destination: remoteRoot/hostname/sourceFileName.any
+			srcFs,  // Upload dir source: user-defined
+			true,   // Upload empty source dirs?
+		)
+		if simulate {
+			session.reportDryRun(ctx, path, absPath, remotePath, err, errs)
+		} else if err != nil {
+			errs.Add(UploadError.Error(path, err.Error()))
+			return
 		} else {
-			logger.Infof("Would upload dir: '%s' ---> '%s'", path, remotePath)
+			logger.Infof("Upload dir: '%s' ---> '%s'", path, remotePath)
 		}
 	} else {
 		// Upload file to remote
 		remotePath, err := session.getRemotePath(parent)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
 
 		// Destination and source filesystems
-		destFs, err := initFs(session.context, remotePath)
+		destFs, err := initFs(ctx, remotePath)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
-		srcFs, err := initFs(session.context, parent)
+		srcFs, err := initFs(ctx, parent)
 		if err != nil {
-			errCh <- UploadError.Error(path, err.Error())
+			errs.Add(UploadError.Error(path, err.Error()))
 			return
 		}
 
-		// Upload
-		if !simulate {
-			if err = rc_ops.CopyFile(
-				session.context,
-				destFs, // Upload file destination: remoteRoot/hostname/sourceFileName.any
-				srcFs,  // Upload file source: user-defined
-				currFile.Name(),
-				currFile.Name(),
-			); err != nil {
-				errCh <- UploadError.Error(path, err.Error())
-				return
-			} else {
-				logger.Infof("Upload file: '%s' ---> '%s'", path, remotePath)
-			}
+		// Upload, keeping the file if it gets overwritten
+		err = rc_ops.CopyFile(
+			session.withVersioning(ctx, destFs, parent),
+			destFs, // Upload file destination: remoteRoot/hostname/sourceFileName.any
+			srcFs,  // Upload file source: user-defined
+			currFile.Name(),
+			currFile.Name(),
+		)
+		if simulate {
+			session.reportDryRun(ctx, path, parent, remotePath, err, errs)
+		} else if err != nil {
+			errs.Add(UploadError.Error(path, err.Error()))
+			return
 		} else {
-			logger.Infof("Would upload file: '%s' ---> '%s'", path, remotePath)
+			logger.Infof("Upload file: '%s' ---> '%s'", path, remotePath)
 		}
 	}
 }
 
-// not gonna happen for a while
-func (session *BackupSession) downloadPath(path string, wg *sync.WaitGroup, errCh chan BackupError, simulate bool) {
-	t0 := time.Now()
-	logger.Infof("DOWNLOADED! (%v)\n", time.Since(t0))
+func (session *BackupSession) downloadPath(path string, wg *sync.WaitGroup, transfers *ErrorList, simulate bool) {
+	defer wg.Done()
+
+	// Mutex lock
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if _, ok := session.processed[path]; ok {
+		logger.Warnf("Path already processed: '%s'", path)
+		return
+	}
+	session.processed[path] = true
+
+	// The path counts as a single transfer, however many errors it reports
+	errs := &ErrorList{}
+	defer session.recordTransfer(path, errs, transfers)
+
+	// Paths chosen to fail are not transferred
+	if fault, ok := session.faults.forPath(path); ok {
+		errs.Add(fault)
+		return
+	}
+
+	// Patterns can only be matched against what's on the remote:
+	// download their fixed part, filtering out whatever doesn't match the rest.
+	ctx := session.context
+	pattern := ""
+	if isPattern(path) {
+		prefix, rest := splitPattern(path)
+		fi, err := newPatternFilter(rest)
+		if err != nil {
+			errs.Add(PathError.Error(path, err.Error()))
+			return
+		}
+		ctx = rc_filter.ReplaceConfig(ctx, fi)
+		pattern = rest
+		path = prefix
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return
+	}
+	localPath, err := session.getLocalPath(absPath)
+	if err != nil {
+		errs.Add(PathError.Error(path, err.Error()))
+		return
+	}
+	remotePath, err := session.getRemotePath(absPath)
+	if err != nil {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+
+	// Go-backup's own files may be inside the source
+	ctx, err = session.excludeMeta(ctx, remotePath)
+	if err != nil {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+
+	if pattern != "" {
+		logger.Infof("Downloading files matching '%s' from '%s'", pattern, remotePath)
+	}
+
+	// Restore the files as they were when the snapshot was taken
+	if session.snapshot != nil {
+		if simulate {
+			logger.Infof("Would download from snapshot %s: '%s' ---> '%s'", session.snapshot.ID, remotePath, localPath)
+		}
+		if err := session.restoreSnapshotPath(ctx, absPath, localPath, simulate); err != nil {
+			errs.Add(DownloadError.Error(path, err.Error()))
+			return
+		}
+		if !simulate {
+			logger.Infof("Download from snapshot %s: '%s' ---> '%s'", session.snapshot.ID, remotePath, localPath)
+		}
+		return
+	}
+
+	// If the remote path points to a file, rclone returns its parent directory
+	srcFs, err := rc_fs.NewFs(ctx, remotePath)
+	isFile := errors.Is(err, rc_fs.ErrorIsFile)
+	if err != nil && !isFile {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+
+	if isFile {
+		remoteName := slashpath.Base(remotePath)
+		localName := filepath.Base(localPath)
+
+		if simulate {
+			logger.Infof("Would download file: '%s' ---> '%s'", remotePath, localPath)
+			return
+		}
+
+		destFs, err := initFs(ctx, filepath.Dir(localPath))
+		if err != nil {
+			errs.Add(DownloadError.Error(path, err.Error()))
+			return
+		}
+		if err = rc_ops.CopyFile(ctx, destFs, srcFs, localName, remoteName); err != nil {
+			errs.Add(DownloadError.Error(path, err.Error()))
+			return
+		}
+		logger.Infof("Download file: '%s' ---> '%s'", remotePath, localPath)
+		return
+	}
+
+	// Nothing to restore if the directory was never uploaded
+	if _, err := srcFs.List(ctx, ""); err != nil {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+
+	if simulate {
+		logger.Infof("Would download dir: '%s' ---> '%s'", remotePath, localPath)
+		err := rc_walk.ListR(ctx, srcFs, "", false, -1, rc_walk.ListObjects, func(entries rc_fs.DirEntries) error {
+			for _, entry := range entries {
+				logger.Infof("  '%s' ---> '%s' (%s)",
+					slashpath.Join(remotePath, entry.Remote()),
+					filepath.Join(localPath, filepath.FromSlash(entry.Remote())),
+					rc_fs.SizeSuffix(entry.Size()),
+				)
+			}
+			return nil
+		})
+		if err != nil {
+			errs.Add(DownloadError.Error(path, err.Error()))
+		}
+		return
+	}
+
+	destFs, err := initFs(ctx, localPath)
+	if err != nil {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+	if err = rc_sync.CopyDir(ctx,
+		destFs, // Download dir destination: user-defined, relocated
+		srcFs,  // Download dir source: remoteRoot/hostname/path
+		true,   // Download empty source dirs?
+	); err != nil {
+		errs.Add(DownloadError.Error(path, err.Error()))
+		return
+	}
+	logger.Infof("Download dir: '%s' ---> '%s'", remotePath, localPath)
 }
 
 func (session *BackupSession) getRemotePath(path string) (string, error) {
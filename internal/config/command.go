@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// ShellNone makes a command run its program directly, without any shell.
+const ShellNone = "none"
+
+// Command is a pre or post-transfer command. In the configuration it can be either a plain string,
+// which is split on '&' and run by the system shell as it always was, or an object:
+//
+//	{ "run": "pg_dump", "args": ["-U", "postgres", "-f", "dump.sql"], "dir": "/var/backups" }
+//
+// Objects are never split. Without args, 'run' is a script passed whole to the shell;
+// with args, 'run' is the program to execute and each arg is passed to it as it is.
+type Command struct {
+	// Name other commands can refer to, and the commands that must succeed before this one runs
+	ID    string   `json:"id,omitempty"`
+	Needs []string `json:"needs,omitempty"`
+
+	Run  string   `json:"run"`
+	Args []string `json:"args,omitempty"`
+	// Working directory, relative to the current one
+	Dir string `json:"dir,omitempty"`
+	// Additional environment, as KEY=value
+	Env []string `json:"env,omitempty"`
+	// Shell that runs the script: the system's default if empty, or "none" to run the program directly
+	Shell   string `json:"shell,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+	// How many times to run the command again if it fails, and how long to wait before each retry
+	Retries    int    `json:"retries,omitempty"`
+	RetryDelay string `json:"retry_delay,omitempty"`
+	// Override the machine's output setting
+	Output *bool `json:"output,omitempty"`
+	// Whether the following commands still run if this one fails (default: true)
+	ContinueOnError *bool `json:"continue_on_error,omitempty"`
+	// Exit codes other than 0 meaning success, and those meaning success with a warning
+	OkCodes   []int `json:"ok_codes,omitempty"`
+	WarnCodes []int `json:"warn_codes,omitempty"`
+	// Exit codes with which a pre command signals that there's nothing to do, skipping the run
+	SkipCodes []int `json:"skip_codes,omitempty"`
+	// A pre command whose failure aborts the run
+	Critical bool `json:"critical,omitempty"`
+	// A post command that runs even when the run was aborted or skipped
+	Always bool `json:"always,omitempty"`
+
+	// Whether the command was written as a plain string
+	plain bool
+}
+
+// NewCommand returns a command written as a plain string.
+func NewCommand(s string) Command {
+	return Command{Run: s, plain: true}
+}
+
+// Plain reports whether the command was written as a plain string.
+func (c Command) Plain() bool {
+	return c.plain
+}
+
+// ContinuesOnError reports whether the following commands still run if this one fails.
+func (c Command) ContinuesOnError() bool {
+	return c.ContinueOnError == nil || *c.ContinueOnError
+}
+
+// IsOkCode reports whether the command succeeded exiting with the given code.
+func (c Command) IsOkCode(code int) bool {
+	return code == 0 || slices.Contains(c.OkCodes, code)
+}
+
+// IsWarnCode reports whether the command succeeded with a warning exiting with the given code.
+func (c Command) IsWarnCode(code int) bool {
+	return slices.Contains(c.WarnCodes, code)
+}
+
+// IsSkipCode reports whether the command asked to skip the run exiting with the given code.
+func (c Command) IsSkipCode(code int) bool {
+	return slices.Contains(c.SkipCodes, code)
+}
+
+func (c Command) String() string {
+	if len(c.Args) == 0 {
+		return c.Run
+	}
+	return c.Run + " " + strings.Join(c.Args, " ")
+}
+
+// MarshalJSON writes commands back in the form they were configured in.
+func (c Command) MarshalJSON() ([]byte, error) {
+	if c.plain {
+		return marshal(c.Run)
+	}
+	type command Command
+	return marshal(command(c))
+}
+
+// UnmarshalJSON reads commands written either as plain strings or as objects.
+func (c *Command) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = NewCommand(s)
+		return nil
+	}
+	type command Command
+	return decodeStrict(data, (*command)(c))
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decodeMachine decodes a machine the way the configuration is loaded.
+func decodeMachine(t *testing.T, data string) *Machine {
+	t.Helper()
+	var m *Machine
+	if err := decodeStrict([]byte(data), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDecodeCommands(t *testing.T) {
+	m := decodeMachine(t, `{
+		"hostname": "web-01",
+		"pre": [
+			"cd /srv & tar czf app.tgz app",
+			{"run": "pg_dump", "args": ["-U", "postgres", "-f", "dump.sql"], "dir": "/var/backups", "env": ["PGHOST=db"]},
+			{"run": "echo $HOME && exit 3", "shell": "bash", "timeout": "1m", "output": false, "continue_on_error": false}
+		]
+	}`)
+
+	if len(m.Pre) != 3 {
+		t.Fatalf("decoded %d pre commands, want 3", len(m.Pre))
+	}
+
+	plain := m.Pre[0]
+	if !plain.Plain() || plain.Run != "cd /srv & tar czf app.tgz app" {
+		t.Errorf("plain string decoded as %+v", plain)
+	}
+
+	program := m.Pre[1]
+	if program.Plain() {
+		t.Error("object decoded as a plain command")
+	}
+	if program.Run != "pg_dump" || !reflect.DeepEqual(program.Args, []string{"-U", "postgres", "-f", "dump.sql"}) {
+		t.Errorf("program decoded as %+v", program)
+	}
+	if program.Dir != "/var/backups" || !reflect.DeepEqual(program.Env, []string{"PGHOST=db"}) {
+		t.Errorf("dir and env decoded as %q, %q", program.Dir, program.Env)
+	}
+	if !program.ContinuesOnError() || program.Output != nil {
+		t.Errorf("unset options decoded as %+v", program)
+	}
+	if got := program.String(); got != "pg_dump -U postgres -f dump.sql" {
+		t.Errorf("String() = %q", got)
+	}
+
+	script := m.Pre[2]
+	if script.Shell != "bash" || script.Timeout != "1m" || script.Output == nil || *script.Output {
+		t.Errorf("script decoded as %+v", script)
+	}
+	if script.ContinuesOnError() {
+		t.Error("continue_on_error: false was ignored")
+	}
+}
+
+func TestMarshalCommand(t *testing.T) {
+	tests := []struct {
+		command Command
+		want    string
+	}{
+		{NewCommand("tar czf a.tgz a"), `"tar czf a.tgz a"`},
+		{Command{Run: "echo hi"}, `{"run":"echo hi"}`},
+		{Command{Run: "tar", Args: []string{"czf", "a.tgz", "a"}, Shell: ShellNone}, `{"run":"tar","args":["czf","a.tgz","a"],"shell":"none"}`},
+	}
+
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("json.Marshal(%+v) = %s, want %s", tt.command, got, tt.want)
+		}
+	}
+}
@@ -21,30 +21,95 @@ var Global *GlobalConfig
 
 // GlobalConfig represents the top-level configuration
 type GlobalConfig struct {
+	// Lets editors find the schema of the file
+	Schema   string     `json:"$schema,omitempty"`
 	Machines []*Machine `json:"machines"`
+	// Settings shared by the machines extending them, by name
+	Profiles map[string]*Machine `json:"profiles,omitempty"`
 }
 
 // Machine represents a single machine configuration
 type Machine struct {
-	Hostname string   `json:"hostname"`
-	Paths    []string `json:"paths"`
-	Output   bool     `json:"output"`
-	Pre      []string `json:"pre"`
-	Post     []string `json:"post"`
+	// The machine's hostname, or a pattern matching several: a glob like "web-*", or a regular expression like "/^web-[0-9]+$/"
+	Hostname string `json:"hostname"`
+	// Profiles whose settings the machine starts from, in order
+	Extends []string `json:"extends,omitempty"`
+	// Tags the machine must have for this entry to match it, given with --tags or in $GOBACKUP_TAGS
+	Tags  []string    `json:"tags,omitempty"`
+	Paths []PathEntry `json:"paths"`
+	// Whether the output of commands is logged (default: false)
+	Output *bool     `json:"output,omitempty"`
+	Pre    []Command `json:"pre"`
+	Post   []Command `json:"post"`
+	// Post commands depending on the outcome of the run
+	OnSuccess []Command `json:"on_success,omitempty"`
+	OnFailure []Command `json:"on_failure,omitempty"`
+	Always    []Command `json:"always,omitempty"`
+	// What to do when configured paths overlap or collide on the remote: "warn" (default) or "fail"
+	PathConflicts string `json:"path_conflicts,omitempty"`
+	// What to do when a pre command fails: "continue" (default) or "abort"
+	PreFailure string `json:"pre_failure,omitempty"`
+	// How long commands may run unless they set their own timeout, and how long to wait between them
+	CommandTimeout string `json:"command_timeout,omitempty"`
+	CommandDelay   string `json:"command_delay,omitempty"`
+	// How many commands depending on others may run at the same time
+	CommandParallelism int `json:"command_parallelism,omitempty"`
+	// How many bytes of a command's error output are kept for its error message
+	StderrLimit int `json:"stderr_limit,omitempty"`
+	// Run the commands of a phase in a single shell process: "pre", "post" or "all"
+	PersistentShell string `json:"persistent_shell,omitempty"`
+	// Regular expressions matching secrets to mask in logs and notifications
+	Redact []string `json:"redact,omitempty"`
+	// Errors to inject deliberately in simulations, to test notifications and monitoring
+	Faults *Faults `json:"faults,omitempty"`
+	// How long snapshots are kept on the remote
+	Retention *Retention `json:"retention,omitempty"`
+	// Sets of paths and commands run on their own, by name
+	Jobs map[string]*Job `json:"jobs,omitempty"`
 }
 
+// Faults describes errors injected deliberately in a session.
+// Rules fail the paths or commands they match; on top of those, a share of the others
+// fails at the given rate, deterministically for the same seed.
+type Faults struct {
+	Rules []FaultRule `json:"rules,omitempty"`
+	Rate  float64     `json:"rate,omitempty"`
+	Seed  int64       `json:"seed,omitempty"`
+	Codes []string    `json:"codes,omitempty"`
+}
+
+// FaultRule fails the paths or commands matching a pattern, where '*' matches anything, with an error code.
+type FaultRule struct {
+	Path    string `json:"path,omitempty"`
+	Command string `json:"command,omitempty"`
+	Code    string `json:"code"`
+}
+
+const (
+	ConflictsWarn = "warn"
+	ConflictsFail = "fail"
+
+	PreFailureContinue = "continue"
+	PreFailureAbort    = "abort"
+
+	PersistentShellPre  = "pre"
+	PersistentShellPost = "post"
+	PersistentShellAll  = "all"
+)
+
 func getConfig() (*GlobalConfig, error) {
 	if Global == nil {
-		if err := viper.Unmarshal(&Global); err != nil {
+		// Decode the file itself: viper lowercases the keys of maps, like the names of profiles and jobs
+		global, err := Load(viper.ConfigFileUsed())
+		if err != nil {
 			return nil, err
 		}
+		Global = global
 	}
 	return Global, nil
 }
 
 func GetCurrentMachine() (*Machine, error) {
-	var current *Machine
-
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
@@ -56,48 +121,40 @@ func GetCurrentMachine() (*Machine, error) {
 	}
 
 	// Check if current machine is configured
-	for _, m := range globalConfig.Machines {
-		if m.Hostname == hostname {
-			current = m
-			break
-		}
-	}
-
-	// Check if current machine is configured
+	tags := HostTags()
+	configured := globalConfig.Match(hostname, tags)
 	modified := false
-	if current != nil {
-		logger.Debugf("Found machine in config: %s", hostname)
+	if configured == nil && globalConfig.Machine(hostname) != nil {
+		// Adding another entry with the same hostname would leave the file ambiguous
+		return nil, fmt.Errorf("machine '%s' is only configured with tags it doesn't have: %s (give them with --tags or in $%s)", hostname, strings.Join(globalConfig.Machine(hostname).Tags, ", "), TagsEnv)
+	}
+	if configured != nil {
+		if configured.Hostname == hostname {
+			logger.Debugf("Found machine in config: %s", hostname)
+		} else {
+			logger.Debugf("Found machine in config: %s (matches %s)", hostname, configured.Hostname)
+		}
 	} else {
 		logger.Info("Current machine is not configured.")
-		current = &Machine{
-			Hostname: hostname,
-			Paths:    []string{},
-			Output:   true,
-			Pre:      []string{},
-			Post:     []string{},
-		}
-		globalConfig.Machines = append(globalConfig.Machines, current)
-		//globalConfig.Machines[hostname] = *current
+		configured = globalConfig.AddMachine(hostname)
 		modified = true
 	}
 
-	// Manipulate paths before use
-	for i, p := range current.Paths {
-		expanded, err := utils.CleanPath(p)
-		if err != nil {
-			return nil, err
-		}
+	// Apply the profiles it extends
+	current, err := globalConfig.Resolve(configured, hostname)
+	if err != nil {
+		return nil, err
+	}
 
-		if p != expanded {
-			current.Paths[i] = expanded
-			// modified = true
-		}
+	// Manipulate paths before use
+	if current.Paths, err = cleanPaths(current.Paths); err != nil {
+		return nil, err
 	}
 
 	// Write changes to config
 	if modified {
 		viper.Set("machines", globalConfig.Machines)
-		if err := viper.WriteConfig(); err != nil {
+		if err := globalConfig.Save(viper.ConfigFileUsed()); err != nil {
 			return nil, err
 		}
 	}
@@ -105,6 +162,47 @@ func GetCurrentMachine() (*Machine, error) {
 	return current, nil
 }
 
+// cleanPaths returns a copy of the paths with environment variables expanded.
+func cleanPaths(paths []PathEntry) ([]PathEntry, error) {
+	cleaned := make([]PathEntry, len(paths))
+	for i, p := range paths {
+		expanded, err := utils.CleanPath(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		cleaned[i] = p
+		cleaned[i].Path = expanded
+	}
+	return cleaned, nil
+}
+
+// ShowsOutput reports whether the output of commands is logged, unless they override it.
+func (m *Machine) ShowsOutput() bool {
+	return m.Output != nil && *m.Output
+}
+
+// PathList returns the configured paths, without their commands.
+func (m *Machine) PathList() []string {
+	paths := make([]string, len(m.Paths))
+	for i, p := range m.Paths {
+		paths[i] = p.Path
+	}
+	return paths
+}
+
+// FindMachine returns the configuration the machine with the given hostname runs with, or nil if it isn't configured.
+func FindMachine(hostname string) (*Machine, error) {
+	globalConfig, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	m := globalConfig.Match(hostname, HostTags())
+	if m == nil {
+		return nil, nil
+	}
+	return globalConfig.Resolve(m, hostname)
+}
+
 func AsValidRemote(ctx context.Context, remote string, unattended bool) (string, error) {
 	// Configure rclone
 	var once sync.Once
@@ -192,6 +290,17 @@ func AsValidRemote(ctx context.Context, remote string, unattended bool) (string,
 	}
 }
 
+// RemoteDefined reports whether a remote is defined in rclone's configuration.
+func RemoteDefined(remote string) bool {
+	rc_configfile.Install()
+	for _, r := range rc_config.FileSections() {
+		if r == remote {
+			return true
+		}
+	}
+	return false
+}
+
 func chooseRemote() string {
 	var c string
 	for c == "" {
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useConfig makes the configuration be read from a temporary file with the given content,
+// where $HOSTNAME is replaced with the hostname of this machine. It returns the file.
+func useConfig(t *testing.T, data string) string {
+	t.Helper()
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(strings.ReplaceAll(data, "$HOSTNAME", hostname)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.SetConfigFile(file)
+	Global = nil
+	t.Cleanup(func() {
+		viper.SetConfigFile("")
+		Global = nil
+	})
+	return file
+}
+
+func TestProfileNamesKeepTheirCase(t *testing.T) {
+	useConfig(t, `{
+		"machines": [{"hostname": "$HOSTNAME", "extends": ["WebNodes"], "paths": [], "pre": [], "post": []}],
+		"profiles": {"WebNodes": {"pre": ["echo from the profile"]}}
+	}`)
+
+	m, err := GetCurrentMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pre) != 1 || m.Pre[0].Run != "echo from the profile" {
+		t.Errorf("pre = %+v, want the commands of the profile", m.Pre)
+	}
+}
+
+func TestAddedMachineKeepsTheFile(t *testing.T) {
+	file := useConfig(t, `{
+		"machines": [{"hostname": "not-this-one", "extends": ["WebNodes"], "paths": [], "pre": [], "post": []}],
+		"profiles": {"WebNodes": {"pre": ["echo from the profile"]}}
+	}`)
+
+	// The machine isn't configured: it's added, and the file written again
+	if _, err := GetCurrentMachine(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Machines) != 2 || saved.Machines[0].Extends[0] != "WebNodes" {
+		t.Errorf("machines saved as %+v", saved.Machines)
+	}
+	if _, ok := saved.Profiles["WebNodes"]; !ok {
+		t.Errorf("profiles saved as %+v, want 'WebNodes' as it was", saved.Profiles)
+	}
+}
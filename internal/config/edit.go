@@ -0,0 +1,173 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// NewMachine returns the configuration of a machine with nothing to back up yet.
+func NewMachine(hostname string) *Machine {
+	output := true
+	return &Machine{
+		Hostname: hostname,
+		Paths:    []PathEntry{},
+		Output:   &output,
+		Pre:      []Command{},
+		Post:     []Command{},
+	}
+}
+
+// Load reads a configuration file, refusing unknown fields.
+func Load(file string) (*GlobalConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var global GlobalConfig
+	if err := decodeStrict(data, &global); err != nil {
+		return nil, fmt.Errorf("invalid configuration (run 'go-backup config validate' for details): %w", err)
+	}
+	return &global, nil
+}
+
+// decodeStrict decodes a JSON value like json.Unmarshal, but refuses unknown fields.
+// The decoder doesn't pass the setting on to UnmarshalJSON methods, so they decode their objects with this too.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Save writes the configuration to a file atomically: the file is either left as it was, or fully replaced.
+func (g *GlobalConfig) Save(file string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(g); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	// Keep the permissions of the file being replaced
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Write next to the file, so that renaming doesn't cross filesystems
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// marshal encodes a value like json.Marshal, but leaves characters such as '&' and '>' as they are,
+// since commands are full of them.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Machine returns the configuration of the machine with the given hostname, or nil if it isn't configured.
+func (g *GlobalConfig) Machine(hostname string) *Machine {
+	for _, m := range g.Machines {
+		if m != nil && m.Hostname == hostname {
+			return m
+		}
+	}
+	return nil
+}
+
+// AddMachine returns the configuration with the given hostname, adding one for it if there's none.
+// Patterns matching the hostname don't count: their configuration is shared with other machines.
+func (g *GlobalConfig) AddMachine(hostname string) *Machine {
+	if m := g.Machine(hostname); m != nil {
+		return m
+	}
+	m := NewMachine(hostname)
+	g.Machines = append(g.Machines, m)
+	return m
+}
+
+// RenameMachine changes the hostname of a configured machine.
+func (g *GlobalConfig) RenameMachine(hostname string, newHostname string) error {
+	m := g.Machine(hostname)
+	if m == nil {
+		return fmt.Errorf("machine '%s' is not configured", hostname)
+	}
+	if newHostname == "" {
+		return fmt.Errorf("the new hostname is empty")
+	}
+	if g.Machine(newHostname) != nil {
+		return fmt.Errorf("machine '%s' is already configured", newHostname)
+	}
+	m.Hostname = newHostname
+	return nil
+}
+
+// RemoveMachine removes a machine from the configuration.
+func (g *GlobalConfig) RemoveMachine(hostname string) error {
+	for i, m := range g.Machines {
+		if m != nil && m.Hostname == hostname {
+			g.Machines = append(g.Machines[:i], g.Machines[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("machine '%s' is not configured", hostname)
+}
+
+// AddPath adds a path to back up, unless it's already configured.
+func (m *Machine) AddPath(path string) error {
+	if m.pathIndex(path) >= 0 {
+		return fmt.Errorf("'%s' is already configured", path)
+	}
+	m.Paths = append(m.Paths, NewPathEntry(path))
+	return nil
+}
+
+// RemovePath removes a configured path, along with its commands.
+func (m *Machine) RemovePath(path string) error {
+	i := m.pathIndex(path)
+	if i < 0 {
+		return fmt.Errorf("'%s' is not configured", path)
+	}
+	m.Paths = append(m.Paths[:i], m.Paths[i+1:]...)
+	return nil
+}
+
+// pathIndex returns the index of a configured path, comparing them as they're written or once cleaned.
+func (m *Machine) pathIndex(path string) int {
+	for i, p := range m.Paths {
+		if p.Path == path || filepath.Clean(p.Path) == filepath.Clean(path) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Job is a named set of paths and commands of a machine, run on its own with 'upload --job <name>':
+//
+//	"jobs": { "hourly": { "paths": ["~/Documents"], "remote": "MyDrive", "retention": { "snapshots": 48 } } }
+//
+// Everything a job doesn't set, like timeouts or redaction, comes from its machine.
+type Job struct {
+	Paths []PathEntry `json:"paths"`
+	Pre   []Command   `json:"pre,omitempty"`
+	Post  []Command   `json:"post,omitempty"`
+	// Post commands depending on the outcome of the run
+	OnSuccess []Command `json:"on_success,omitempty"`
+	OnFailure []Command `json:"on_failure,omitempty"`
+	Always    []Command `json:"always,omitempty"`
+	// Where the job's files go, unless given on the command line
+	Remote string `json:"remote,omitempty"`
+	Root   string `json:"root,omitempty"`
+	// How long the job's snapshots are kept, instead of the machine's retention
+	Retention *Retention `json:"retention,omitempty"`
+	// The job's own health monitors, instead of those in the environment
+	Monitors *Monitors `json:"monitors,omitempty"`
+}
+
+// Retention limits the snapshots kept on the remote. When a snapshot is deleted,
+// so are the previous versions of files that only it could restore.
+type Retention struct {
+	// How many snapshots to keep at most
+	Snapshots int `json:"snapshots,omitempty"`
+	// How old snapshots may get, e.g. "720h"
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// Monitors are the IDs of health monitors, which may refer to environment variables like "$HC_NIGHTLY".
+type Monitors struct {
+	Healthchecks string `json:"healthchecks,omitempty"`
+	BetterUptime string `json:"betteruptime,omitempty"`
+}
+
+// Job names are also directory names on the remote
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidJobName checks that a job can be named as given.
+func ValidJobName(name string) error {
+	if !jobNamePattern.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid job name '%s': use only letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// JobNames returns the names of the machine's jobs, sorted.
+func (m *Machine) JobNames() []string {
+	names := make([]string, 0, len(m.Jobs))
+	for name := range m.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForJob returns the configuration of the machine running one of its jobs:
+// the job's paths and commands take the place of the machine's own.
+func (m *Machine) ForJob(name string) (*Machine, *Job, error) {
+	job, ok := m.Jobs[name]
+	if !ok || job == nil {
+		if len(m.Jobs) == 0 {
+			return nil, nil, fmt.Errorf("job '%s' is not configured: %s has no jobs", name, m.Hostname)
+		}
+		return nil, nil, fmt.Errorf("job '%s' is not configured (%s has: %s)", name, m.Hostname, strings.Join(m.JobNames(), ", "))
+	}
+
+	if err := ValidJobName(name); err != nil {
+		return nil, nil, err
+	}
+	paths, err := cleanPaths(job.Paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jm := *m
+	jm.Paths = paths
+	jm.Pre = job.Pre
+	jm.Post = job.Post
+	jm.OnSuccess = job.OnSuccess
+	jm.OnFailure = job.OnFailure
+	jm.Always = job.Always
+	if job.Retention != nil {
+		jm.Retention = job.Retention
+	}
+	jm.Jobs = nil
+	return &jm, job, nil
+}
+
+// FindJob returns a job of the machine with the given hostname, which must be configured.
+func FindJob(hostname string, name string) (*Job, error) {
+	m, err := FindMachine(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("job '%s' is not configured: %s is not configured", name, hostname)
+	}
+	_, job, err := m.ForJob(name)
+	return job, err
+}
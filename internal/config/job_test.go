@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidJobName(t *testing.T) {
+	for _, name := range []string{"nightly", "Hourly-2", "db_dump.v2", "..a"} {
+		if err := ValidJobName(name); err != nil {
+			t.Errorf("ValidJobName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "night ly", "a/b", "é"} {
+		if err := ValidJobName(name); err == nil {
+			t.Errorf("ValidJobName(%q) accepted an invalid name", name)
+		}
+	}
+}
+
+func TestForJob(t *testing.T) {
+	weekly := &Retention{Snapshots: 4}
+	m := &Machine{
+		Hostname:       "web-01",
+		Paths:          []PathEntry{NewPathEntry("/etc")},
+		Pre:            []Command{NewCommand("echo machine")},
+		CommandTimeout: "5m",
+		Retention:      &Retention{MaxAge: "720h"},
+		Jobs: map[string]*Job{
+			"nightly": {
+				Paths:     []PathEntry{NewPathEntry("/srv/data/")},
+				Post:      []Command{NewCommand("echo job")},
+				Retention: weekly,
+			},
+			"hourly": {Paths: []PathEntry{NewPathEntry("/home")}},
+		},
+	}
+
+	jm, job, err := m.ForJob("nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != m.Jobs["nightly"] {
+		t.Errorf("ForJob() returned the job %+v", job)
+	}
+	if !reflect.DeepEqual(jm.PathList(), []string{"/srv/data"}) {
+		t.Errorf("paths = %q, want the job's, cleaned", jm.PathList())
+	}
+	if len(jm.Pre) != 0 || len(jm.Post) != 1 {
+		t.Errorf("commands = %+v, %+v, want the job's instead of the machine's", jm.Pre, jm.Post)
+	}
+	if jm.CommandTimeout != "5m" || jm.Retention != weekly || jm.Jobs != nil {
+		t.Errorf("settings = %+v, want the machine's, with the job's retention", jm)
+	}
+	if len(m.Pre) != 1 || m.Paths[0].Path != "/etc" {
+		t.Error("ForJob() changed the machine")
+	}
+
+	// A job without a retention keeps the machine's
+	if jm, _, _ := m.ForJob("hourly"); jm.Retention != m.Retention {
+		t.Errorf("retention = %+v, want the machine's", jm.Retention)
+	}
+
+	_, _, err = m.ForJob("weekly")
+	if err == nil || !strings.Contains(err.Error(), "hourly, nightly") {
+		t.Errorf("ForJob(weekly) = %v, want an error listing the jobs", err)
+	}
+}
+
+func TestFindJob(t *testing.T) {
+	useConfig(t, `{
+		"machines": [{
+			"hostname": "$HOSTNAME", "extends": ["Laptops"], "paths": [], "pre": [], "post": [],
+			"jobs": {"Nightly": {"paths": ["/srv"], "remote": "Offsite"}}
+		}],
+		"profiles": {"Laptops": {"jobs": {"Hourly-Docs": {"paths": ["/home"]}}}}
+	}`)
+	hostname, _ := os.Hostname()
+
+	job, err := FindJob(hostname, "Nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Remote != "Offsite" {
+		t.Errorf("FindJob(Nightly) = %+v", job)
+	}
+
+	m, err := GetCurrentMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.ForJob("Hourly-Docs"); err != nil {
+		t.Errorf("ForJob(Hourly-Docs) = %v, want the job of the profile", err)
+	}
+	if _, _, err := m.ForJob("nightly"); err == nil {
+		t.Error("ForJob(nightly) found a job named 'Nightly'")
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+// PathEntry is a path to transfer. In the configuration it can be either a plain string, or an object
+// with commands to run right before and after its upload:
+//
+//	{ "path": "/srv/app/data", "pre": ["docker stop app"], "post": ["docker start app"] }
+type PathEntry struct {
+	Path string    `json:"path"`
+	Pre  []Command `json:"pre,omitempty"`
+	Post []Command `json:"post,omitempty"`
+
+	// Whether the path was written as a plain string
+	plain bool
+}
+
+// NewPathEntry returns a path written as a plain string.
+func NewPathEntry(path string) PathEntry {
+	return PathEntry{Path: path, plain: true}
+}
+
+// HasHooks reports whether commands must run around the transfer of the path.
+func (p PathEntry) HasHooks() bool {
+	return len(p.Pre) > 0 || len(p.Post) > 0
+}
+
+// MarshalJSON writes paths back in the form they were configured in.
+func (p PathEntry) MarshalJSON() ([]byte, error) {
+	if p.plain {
+		return marshal(p.Path)
+	}
+	type pathEntry PathEntry
+	return marshal(pathEntry(p))
+}
+
+// UnmarshalJSON reads paths written either as plain strings or as objects.
+func (p *PathEntry) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*p = NewPathEntry(s)
+		return nil
+	}
+	type pathEntry PathEntry
+	return decodeStrict(data, (*pathEntry)(p))
+}
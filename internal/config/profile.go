@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// TagsEnv is the environment variable listing the tags of this machine, separated by commas.
+const TagsEnv = "GOBACKUP_TAGS"
+
+// Tags given on the command line, which take the place of those in the environment
+var hostTags []string
+
+// SetHostTags sets the tags of this machine, instead of those in $GOBACKUP_TAGS.
+func SetHostTags(tags []string) {
+	hostTags = tags
+}
+
+// HostTags returns the tags of this machine: those given on the command line, or else those in $GOBACKUP_TAGS.
+func HostTags() []string {
+	if hostTags != nil {
+		return hostTags
+	}
+	return ParseTags(os.Getenv(TagsEnv))
+}
+
+// ParseTags splits a list of tags separated by commas, dropping empty ones.
+func ParseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// MatchTags reports whether a machine with the given tags has all those an entry requires.
+func MatchTags(required []string, tags []string) bool {
+	for _, tag := range required {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsHostnamePattern reports whether a configured hostname matches several machines:
+// a glob like "web-*", or a regular expression between slashes like "/^web-[0-9]+$/".
+func IsHostnamePattern(hostname string) bool {
+	return isHostnameRegexp(hostname) || strings.ContainsAny(hostname, "*?[")
+}
+
+func isHostnameRegexp(hostname string) bool {
+	return len(hostname) > 2 && strings.HasPrefix(hostname, "/") && strings.HasSuffix(hostname, "/")
+}
+
+// MatchHostname reports whether a configured hostname, which may be a pattern, matches the hostname of a machine.
+func MatchHostname(pattern string, hostname string) (bool, error) {
+	switch {
+	case pattern == hostname:
+		return true, nil
+	case isHostnameRegexp(pattern):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, fmt.Errorf("invalid hostname pattern '%s': %s", pattern, err)
+		}
+		return re.MatchString(hostname), nil
+	case IsHostnamePattern(pattern):
+		matched, err := path.Match(pattern, hostname)
+		if err != nil {
+			return false, fmt.Errorf("invalid hostname pattern '%s': %s", pattern, err)
+		}
+		return matched, nil
+	}
+	return false, nil
+}
+
+// Match returns the configuration of a machine with the given tags: the one with its exact hostname if there's one,
+// or else the first whose hostname is a pattern matching it. Entries with tags only match machines having all of them.
+// It returns nil if none matches.
+func (g *GlobalConfig) Match(hostname string, tags []string) *Machine {
+	for _, m := range g.Machines {
+		if m != nil && m.Hostname == hostname && MatchTags(m.Tags, tags) {
+			return m
+		}
+	}
+	for _, m := range g.Machines {
+		if m == nil || !IsHostnamePattern(m.Hostname) || !MatchTags(m.Tags, tags) {
+			continue
+		}
+		// Invalid patterns are reported by validation, and simply match nothing
+		if matched, _ := MatchHostname(m.Hostname, hostname); matched {
+			return m
+		}
+	}
+	return nil
+}
+
+// Resolve returns the configuration a machine runs with: the profiles it extends, merged in order,
+// then its own. The result has the hostname of the machine, even if it was configured with a pattern.
+func (g *GlobalConfig) Resolve(m *Machine, hostname string) (*Machine, error) {
+	resolved, err := g.resolve(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	resolved.Hostname = hostname
+	resolved.Extends = nil
+	return resolved, nil
+}
+
+func (g *GlobalConfig) resolve(m *Machine, chain []string) (*Machine, error) {
+	resolved := &Machine{}
+	for _, name := range m.Extends {
+		for _, c := range chain {
+			if c == name {
+				return nil, fmt.Errorf("profile '%s' extends itself: %s -> %s", name, strings.Join(chain, " -> "), name)
+			}
+		}
+		profile, ok := g.Profiles[name]
+		if !ok || profile == nil {
+			return nil, fmt.Errorf("profile '%s' is not defined", name)
+		}
+		base, err := g.resolve(profile, append(chain, name))
+		if err != nil {
+			return nil, err
+		}
+		resolved = merge(resolved, base)
+	}
+	return merge(resolved, m), nil
+}
+
+// merge returns a new configuration with the settings of another laid over those of a base:
+//   - settings that are set replace those of the base;
+//   - lists are appended to those of the base, except that a path already in the base, or a command
+//     with the same id, replaces it where it is;
+//   - jobs are added to those of the base, replacing those with the same name.
+func merge(base *Machine, over *Machine) *Machine {
+	m := &Machine{
+		Hostname:           firstSet(over.Hostname, base.Hostname),
+		Extends:            over.Extends,
+		Tags:               over.Tags,
+		Paths:              mergePaths(base.Paths, over.Paths),
+		Output:             base.Output,
+		Pre:                mergeCommands(base.Pre, over.Pre),
+		Post:               mergeCommands(base.Post, over.Post),
+		OnSuccess:          mergeCommands(base.OnSuccess, over.OnSuccess),
+		OnFailure:          mergeCommands(base.OnFailure, over.OnFailure),
+		Always:             mergeCommands(base.Always, over.Always),
+		PathConflicts:      firstSet(over.PathConflicts, base.PathConflicts),
+		PreFailure:         firstSet(over.PreFailure, base.PreFailure),
+		CommandTimeout:     firstSet(over.CommandTimeout, base.CommandTimeout),
+		CommandDelay:       firstSet(over.CommandDelay, base.CommandDelay),
+		CommandParallelism: firstSet(over.CommandParallelism, base.CommandParallelism),
+		StderrLimit:        firstSet(over.StderrLimit, base.StderrLimit),
+		PersistentShell:    firstSet(over.PersistentShell, base.PersistentShell),
+		Redact:             append(append([]string{}, base.Redact...), over.Redact...),
+		Faults:             base.Faults,
+		Retention:          base.Retention,
+	}
+	if over.Output != nil {
+		m.Output = over.Output
+	}
+	if over.Faults != nil {
+		m.Faults = over.Faults
+	}
+	if over.Retention != nil {
+		m.Retention = over.Retention
+	}
+	if len(base.Jobs) > 0 || len(over.Jobs) > 0 {
+		m.Jobs = make(map[string]*Job)
+		for name, job := range base.Jobs {
+			m.Jobs[name] = job
+		}
+		for name, job := range over.Jobs {
+			m.Jobs[name] = job
+		}
+	}
+	return m
+}
+
+func firstSet[T comparable](values ...T) T {
+	var zero T
+	for _, v := range values {
+		if v != zero {
+			return v
+		}
+	}
+	return zero
+}
+
+func mergePaths(base []PathEntry, over []PathEntry) []PathEntry {
+	merged := append([]PathEntry{}, base...)
+	for _, p := range over {
+		replaced := false
+		for i := range merged {
+			if merged[i].Path == p.Path {
+				merged[i] = p
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+func mergeCommands(base []Command, over []Command) []Command {
+	merged := append([]Command{}, base...)
+	for _, c := range over {
+		replaced := false
+		for i := range merged {
+			if c.ID != "" && merged[i].ID == c.ID {
+				merged[i] = c
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, c)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchHostname(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		hostname string
+		want     bool
+	}{
+		{"web-01", "web-01", true},
+		{"web-01", "web-02", false},
+		{"web-*", "web-02", true},
+		{"web-?", "web-10", false},
+		{"db-[0-9]", "db-3", true},
+		{"/^web-[0-9]+$/", "web-10", true},
+		{"/^web-[0-9]+$/", "web-a", false},
+		// A single slash is a hostname, not an empty regular expression
+		{"/", "web-01", false},
+	}
+
+	for _, tt := range tests {
+		got, err := MatchHostname(tt.pattern, tt.hostname)
+		if err != nil || got != tt.want {
+			t.Errorf("MatchHostname(%q, %q) = %v, %v, want %v", tt.pattern, tt.hostname, got, err, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{"/web-(/", "web-[0-9"} {
+		if _, err := MatchHostname(pattern, "web-1"); err == nil {
+			t.Errorf("MatchHostname(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	g := &GlobalConfig{Machines: []*Machine{
+		{Hostname: "web-01", Tags: []string{"staging"}, PreFailure: "tagged"},
+		{Hostname: "web-*", Tags: []string{"prod", "eu"}, PreFailure: "prod"},
+		{Hostname: "web-*", PreFailure: "first"},
+		{Hostname: "/^web-/", PreFailure: "second"},
+		{Hostname: "web-01", PreFailure: "exact"},
+		{Hostname: "db-[", PreFailure: "invalid"},
+	}}
+
+	tests := []struct {
+		hostname string
+		tags     []string
+		want     string
+	}{
+		{"web-01", nil, "exact"},
+		{"web-01", []string{"staging"}, "tagged"},
+		{"web-02", nil, "first"},
+		{"web-02", []string{"prod"}, "first"},
+		{"web-02", []string{"eu", "prod", "db"}, "prod"},
+		{"db-[", nil, "invalid"},
+		{"db-01", []string{"prod"}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if m := g.Match(tt.hostname, tt.tags); m != nil {
+			got = m.PreFailure
+		}
+		if got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.hostname, tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	if got := ParseTags(" prod,, eu ,"); !reflect.DeepEqual(got, []string{"prod", "eu"}) {
+		t.Errorf("ParseTags() = %q", got)
+	}
+	if got := ParseTags(""); got != nil {
+		t.Errorf("ParseTags(\"\") = %q, want no tags", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dump := Command{ID: "dump", Run: "pg_dump app"}
+	on, off := true, false
+	g := &GlobalConfig{Profiles: map[string]*Machine{
+		"Base": {
+			Output:         &on,
+			Paths:          []PathEntry{NewPathEntry("/etc"), NewPathEntry("/srv")},
+			Pre:            []Command{dump, NewCommand("echo base")},
+			CommandTimeout: "10m",
+			Redact:         []string{"token=(\\S+)"},
+		},
+		"WebNodes": {
+			Extends:    []string{"Base"},
+			Paths:      []PathEntry{{Path: "/srv", Post: []Command{NewCommand("echo srv")}}},
+			PreFailure: PreFailureAbort,
+		},
+	}}
+	m := &Machine{
+		Hostname: "web-*",
+		Extends:  []string{"WebNodes"},
+		Pre:      []Command{{ID: "dump", Run: "pg_dump web"}},
+		Output:   &off,
+	}
+
+	resolved, err := g.Resolve(m, "web-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Hostname != "web-01" || resolved.Extends != nil {
+		t.Errorf("resolved as %q extending %q, want the machine's hostname and no profiles", resolved.Hostname, resolved.Extends)
+	}
+	// Paths and commands with the same id replace those of the profiles where they are
+	if want := []PathEntry{NewPathEntry("/etc"), {Path: "/srv", Post: []Command{NewCommand("echo srv")}}}; !reflect.DeepEqual(resolved.Paths, want) {
+		t.Errorf("paths = %+v, want %+v", resolved.Paths, want)
+	}
+	if len(resolved.Pre) != 2 || resolved.Pre[0].Run != "pg_dump web" || resolved.Pre[1].Run != "echo base" {
+		t.Errorf("pre = %+v, want the machine's dump in place of the profile's", resolved.Pre)
+	}
+	if resolved.CommandTimeout != "10m" || resolved.PreFailure != PreFailureAbort || resolved.ShowsOutput() || len(resolved.Redact) != 1 {
+		t.Errorf("settings = %+v, want those of both profiles and the machine", resolved)
+	}
+	if len(g.Profiles["Base"].Pre) != 2 || g.Profiles["Base"].Pre[0].Run != "pg_dump app" {
+		t.Error("Resolve() changed a profile")
+	}
+
+	g.Profiles["Base"].Extends = []string{"WebNodes"}
+	if _, err := g.Resolve(m, "web-01"); err == nil || !strings.Contains(err.Error(), "WebNodes -> Base -> WebNodes") {
+		t.Errorf("Resolve() = %v, want an error showing the cycle", err)
+	}
+	m.Extends = []string{"DbNodes"}
+	if _, err := g.Resolve(m, "web-01"); err == nil || !strings.Contains(err.Error(), "'DbNodes' is not defined") {
+		t.Errorf("Resolve() = %v, want an error for the undefined profile", err)
+	}
+}
@@ -0,0 +1,779 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0x07cf-dev/go-backup/internal/utils"
+)
+
+// Schema is the JSON schema of the configuration file, for editors and other tools.
+//
+//go:embed schema.json
+var Schema []byte
+
+// Problem is something wrong with a configuration file, found at a line and column.
+type Problem struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (p Problem) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d:%d: ", p.Line, p.Column))
+	if p.Warning {
+		sb.WriteString("warning: ")
+	}
+	if p.Field != "" {
+		sb.WriteString(p.Field + ": ")
+	}
+	sb.WriteString(p.Message)
+	return sb.String()
+}
+
+// ValidateOpts tells what else to check, besides the configuration itself.
+type ValidateOpts struct {
+	// The machine whose paths must exist, usually the current one, and its tags
+	Hostname string
+	Tags     []string
+	// A remote that must be defined in rclone's configuration
+	Remote string
+	// Reports whether plain commands starting with name run a built-in, which isn't checked as a script
+	IsBuiltin func(name string) bool
+}
+
+// Validation is the outcome of validating a configuration file.
+type Validation struct {
+	// The decoded configuration, if it could be decoded
+	Config   *GlobalConfig
+	Problems []Problem
+
+	data      []byte
+	positions map[string]int64
+	opts      ValidateOpts
+}
+
+// Add reports a problem with a field, given as a path like "machines[0].pre[2].timeout".
+func (v *Validation) Add(field string, message string) {
+	v.add(field, message, false)
+}
+
+// Warn reports something that may be wrong with a field, but that doesn't make the configuration invalid.
+func (v *Validation) Warn(field string, message string) {
+	v.add(field, message, true)
+}
+
+func (v *Validation) add(field string, message string, warning bool) {
+	line, column := v.position(field)
+	v.Problems = append(v.Problems, Problem{
+		Line:    line,
+		Column:  column,
+		Field:   field,
+		Message: message,
+		Warning: warning,
+	})
+}
+
+// Failed reports whether any problem makes the configuration invalid.
+func (v *Validation) Failed() bool {
+	for _, p := range v.Problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort orders the problems as they appear in the file.
+func (v *Validation) Sort() {
+	sort.SliceStable(v.Problems, func(i, j int) bool {
+		a, b := v.Problems[i], v.Problems[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// Validate checks a configuration file: its syntax, that it only has known fields of the right type,
+// and that their values make sense.
+func Validate(data []byte, opts ValidateOpts) *Validation {
+	v := &Validation{data: data, positions: make(map[string]int64), opts: opts}
+
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := v.lineColumn(syntaxErr.Offset - 1)
+			v.Problems = append(v.Problems, Problem{Line: line, Column: column, Message: err.Error()})
+		} else {
+			v.Add("", err.Error())
+		}
+		return v
+	}
+	v.indexPositions()
+
+	// Unknown fields and wrong types
+	v.checkType(generic, reflect.TypeOf(GlobalConfig{}), "")
+	if v.Failed() {
+		v.Sort()
+		return v
+	}
+
+	var global GlobalConfig
+	if err := json.Unmarshal(data, &global); err != nil {
+		v.Add("", err.Error())
+		v.Sort()
+		return v
+	}
+	v.Config = &global
+
+	if _, ok := generic.(map[string]any)["machines"]; !ok {
+		v.Add("", "'machines' is required")
+	}
+	var current *Machine
+	if opts.Hostname != "" {
+		current = global.Match(opts.Hostname, opts.Tags)
+	}
+	hostnames := make(map[string]int)
+	for i, m := range global.Machines {
+		field := fmt.Sprintf("machines[%d]", i)
+		if m == nil {
+			v.Add(field, "a machine can't be null")
+			continue
+		}
+		// The same hostname may be configured again for machines with other tags
+		tags := slices.Clone(m.Tags)
+		slices.Sort(tags)
+		key := m.Hostname + " " + strings.Join(tags, ",")
+		if m.Hostname == "" {
+			v.Add(field+".hostname", "'hostname' is required")
+		} else if j, ok := hostnames[key]; ok {
+			v.Add(field+".hostname", fmt.Sprintf("'%s' is already configured by machines[%d]", m.Hostname, j))
+		} else {
+			hostnames[key] = i
+		}
+		for j, tag := range m.Tags {
+			if tag == "" || strings.ContainsAny(tag, ", \t") {
+				v.Add(fmt.Sprintf("%s.tags[%d]", field, j), fmt.Sprintf("invalid tag '%s': tags can't be empty or contain commas or spaces", tag))
+			}
+		}
+		if _, err := MatchHostname(m.Hostname, ""); err != nil {
+			v.Add(field+".hostname", err.Error())
+		}
+		v.checkMachine(m, field, m == current)
+		v.checkExtends(&global, m, field)
+	}
+
+	// Profiles are checked like machines, and their paths must exist if this machine extends them
+	extended := make(map[string]bool)
+	if current != nil {
+		for _, name := range profileNames(&global, current, nil) {
+			extended[name] = true
+		}
+	}
+	for name, p := range global.Profiles {
+		field := "profiles." + name
+		if p == nil {
+			v.Add(field, "a profile can't be null")
+			continue
+		}
+		if p.Hostname != "" {
+			v.Add(field+".hostname", "profiles have no hostname: machines choose the profiles they extend")
+		}
+		if len(p.Tags) > 0 {
+			v.Warn(field+".tags", "profiles aren't matched to machines: tags only apply to entries in 'machines'")
+		}
+		v.checkMachine(p, field, extended[name])
+		v.checkExtends(&global, p, field)
+
+		// Profiles may extend others, as long as they don't end up extending themselves
+		if _, err := global.Resolve(p, ""); err != nil && slices.Contains(profileNames(&global, p, nil), name) {
+			v.Add(field+".extends", err.Error())
+		}
+	}
+
+	if opts.Remote != "" && !filepath.IsAbs(opts.Remote) && !RemoteDefined(opts.Remote) {
+		v.Add("", fmt.Sprintf("remote '%s' is not defined in rclone's configuration", opts.Remote))
+	}
+
+	v.Sort()
+	return v
+}
+
+func (v *Validation) checkMachine(m *Machine, field string, current bool) {
+	v.checkEnum(field+".path_conflicts", m.PathConflicts, ConflictsWarn, ConflictsFail)
+	v.checkEnum(field+".pre_failure", m.PreFailure, PreFailureContinue, PreFailureAbort)
+	v.checkEnum(field+".persistent_shell", m.PersistentShell, PersistentShellPre, PersistentShellPost, PersistentShellAll)
+	v.checkDuration(field+".command_timeout", m.CommandTimeout)
+	v.checkDuration(field+".command_delay", m.CommandDelay)
+	if m.CommandParallelism < 0 {
+		v.Add(field+".command_parallelism", "must not be negative")
+	}
+	if m.StderrLimit < 0 {
+		v.Add(field+".stderr_limit", "must not be negative")
+	}
+
+	v.checkPaths(field+".paths", m.Paths, current)
+	v.checkCommands(field+".pre", m.Pre)
+	v.checkCommands(field+".post", m.Post)
+	v.checkCommands(field+".on_success", m.OnSuccess)
+	v.checkCommands(field+".on_failure", m.OnFailure)
+	v.checkCommands(field+".always", m.Always)
+
+	for i, pattern := range m.Redact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.Add(fmt.Sprintf("%s.redact[%d]", field, i), fmt.Sprintf("invalid regular expression: %s", err))
+		}
+	}
+
+	if m.Faults != nil {
+		if m.Faults.Rate < 0 || m.Faults.Rate > 1 {
+			v.Add(field+".faults.rate", "must be between 0 and 1")
+		}
+		for i, rule := range m.Faults.Rules {
+			if rule.Path == "" && rule.Command == "" {
+				v.Add(fmt.Sprintf("%s.faults.rules[%d]", field, i), "a rule needs a 'path' or a 'command' pattern")
+			}
+		}
+	}
+
+	v.checkRetention(field+".retention", m.Retention)
+	for _, name := range m.JobNames() {
+		v.checkJob(m.Jobs[name], name, field+".jobs."+name, current)
+	}
+}
+
+func (v *Validation) checkJob(job *Job, name string, field string, current bool) {
+	if err := ValidJobName(name); err != nil {
+		v.Add(field, err.Error())
+	}
+	if job == nil {
+		v.Add(field, "a job can't be null")
+		return
+	}
+
+	if job.Monitors == nil || (job.Monitors.Healthchecks == "" && job.Monitors.BetterUptime == "") {
+		v.Warn(field+".monitors", "the job has no monitors of its own: its runs send no heartbeats")
+	}
+
+	v.checkPaths(field+".paths", job.Paths, current)
+	v.checkCommands(field+".pre", job.Pre)
+	v.checkCommands(field+".post", job.Post)
+	v.checkCommands(field+".on_success", job.OnSuccess)
+	v.checkCommands(field+".on_failure", job.OnFailure)
+	v.checkCommands(field+".always", job.Always)
+	v.checkRetention(field+".retention", job.Retention)
+
+	// Only the remotes of this machine's jobs are expected in rclone's configuration
+	if current && job.Remote != "" && !filepath.IsAbs(job.Remote) && !RemoteDefined(job.Remote) {
+		v.Add(field+".remote", fmt.Sprintf("remote '%s' is not defined in rclone's configuration", job.Remote))
+	}
+}
+
+func (v *Validation) checkPaths(field string, paths []PathEntry, current bool) {
+	for i, p := range paths {
+		pathField := fmt.Sprintf("%s[%d]", field, i)
+		if p.Path == "" {
+			v.Add(pathField, "the path is empty")
+			continue
+		}
+		v.checkCommands(pathField+".pre", p.Pre)
+		v.checkCommands(pathField+".post", p.Post)
+
+		// Only the paths of this machine can be looked for
+		if current {
+			v.checkPathExists(pathField, p.Path)
+		}
+	}
+}
+
+func (v *Validation) checkRetention(field string, retention *Retention) {
+	if retention == nil {
+		return
+	}
+	if retention.Snapshots < 0 {
+		v.Add(field+".snapshots", "must not be negative")
+	}
+	v.checkDuration(field+".max_age", retention.MaxAge)
+}
+
+// checkExtends checks that the profiles a machine or profile extends are defined.
+func (v *Validation) checkExtends(global *GlobalConfig, m *Machine, field string) {
+	for i, name := range m.Extends {
+		if p, ok := global.Profiles[name]; !ok || p == nil {
+			v.Add(fmt.Sprintf("%s.extends[%d]", field, i), fmt.Sprintf("profile '%s' is not defined", name))
+		}
+	}
+}
+
+// profileNames returns the names of the profiles a machine extends, directly or through other profiles.
+func profileNames(global *GlobalConfig, m *Machine, seen []string) []string {
+	for _, name := range m.Extends {
+		if slices.Contains(seen, name) {
+			continue
+		}
+		seen = append(seen, name)
+		if p := global.Profiles[name]; p != nil {
+			seen = profileNames(global, p, seen)
+		}
+	}
+	return seen
+}
+
+func (v *Validation) checkCommands(field string, commands []Command) {
+	ids := make(map[string]int)
+	for i, c := range commands {
+		cmdField := fmt.Sprintf("%s[%d]", field, i)
+		v.checkCommand(cmdField, c)
+		if len(c.SkipCodes) > 0 && !strings.HasSuffix(field, ".pre") {
+			v.Warn(cmdField+".skip_codes", "only pre commands can skip the run: these codes count as failures")
+		}
+		if c.ID == "" {
+			continue
+		}
+		if j, ok := ids[c.ID]; ok {
+			v.Add(cmdField+".id", fmt.Sprintf("'%s' is already the id of %s[%d]", c.ID, field, j))
+			continue
+		}
+		ids[c.ID] = i
+	}
+
+	// Needs must refer to other commands of the same list, without cycles
+	for i, c := range commands {
+		for _, need := range c.Needs {
+			if j, ok := ids[need]; !ok || j == i {
+				v.Add(fmt.Sprintf("%s[%d].needs", field, i), fmt.Sprintf("no other command has id '%s'", need))
+			}
+		}
+	}
+	if cycle := findCycle(commands, ids); len(cycle) > 0 {
+		v.Add(fmt.Sprintf("%s[%d].needs", field, ids[cycle[0]]), fmt.Sprintf("dependency cycle: %s", strings.Join(cycle, " -> ")))
+	}
+}
+
+func (v *Validation) checkCommand(field string, c Command) {
+	if c.Run == "" {
+		if c.Plain() {
+			v.Add(field, "the command is empty")
+		} else {
+			v.Add(field+".run", "'run' is required")
+		}
+		return
+	}
+	if c.Plain() {
+		v.checkCmdLine(field, c.Run)
+		return
+	}
+
+	for i, kv := range c.Env {
+		if k, _, found := strings.Cut(kv, "="); !found || k == "" {
+			v.Add(fmt.Sprintf("%s.env[%d]", field, i), fmt.Sprintf("invalid entry '%s': expected KEY=value", kv))
+		}
+	}
+	if len(c.Args) > 0 && c.Shell != "" && c.Shell != ShellNone {
+		v.Add(field+".args", "args can't be passed to a shell: write them in 'run'")
+	}
+	v.checkDuration(field+".timeout", c.Timeout)
+	v.checkDuration(field+".retry_delay", c.RetryDelay)
+	if c.Retries < 0 {
+		v.Add(field+".retries", "must not be negative")
+	}
+	for i, code := range c.SkipCodes {
+		if c.IsOkCode(code) || c.IsWarnCode(code) {
+			v.Warn(fmt.Sprintf("%s.skip_codes[%d]", field, i), fmt.Sprintf("exit code %d already counts as success, so it never skips the run", code))
+		}
+	}
+	if len(c.Args) == 0 && (c.Shell == "" || c.Shell == utils.DefaultShell) {
+		v.checkSyntax(field+".run", c.Run)
+	}
+}
+
+// checkCmdLine checks a command written as a plain string the way it runs: split on '&',
+// each part being either a built-in or a script of its own.
+func (v *Validation) checkCmdLine(field string, command string) {
+	for _, part := range strings.Split(command, "&") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(part, " ")
+		if v.opts.IsBuiltin != nil && v.opts.IsBuiltin(name) {
+			continue
+		}
+		v.checkSyntax(field, part)
+	}
+}
+
+// checkSyntax checks a script that runs in the default shell, if the shell can do it without running the script.
+func (v *Validation) checkSyntax(field string, script string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if _, err := exec.LookPath(utils.DefaultShell); err != nil {
+		return
+	}
+	if out, err := exec.Command(utils.DefaultShell, "-n", "-c", script).CombinedOutput(); err != nil {
+		message := strings.TrimSpace(string(out))
+		if message == "" {
+			message = err.Error()
+		}
+		v.Add(field, fmt.Sprintf("invalid script: %s", message))
+	}
+}
+
+func (v *Validation) checkPathExists(field string, path string) {
+	expanded, err := utils.CleanPath(path)
+	if err != nil {
+		v.Add(field, err.Error())
+		return
+	}
+	// A path that exists as written is never a pattern
+	if _, err := os.Stat(expanded); err == nil {
+		return
+	}
+	if strings.ContainsAny(expanded, "*?[") {
+		matches, err := filepath.Glob(expanded)
+		if err != nil {
+			v.Add(field, fmt.Sprintf("invalid pattern: %s", err))
+		} else if len(matches) == 0 {
+			v.Warn(field, fmt.Sprintf("'%s' matches nothing", path))
+		}
+		return
+	}
+	v.Add(field, fmt.Sprintf("'%s' does not exist", path))
+}
+
+func (v *Validation) checkEnum(field string, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.Add(field, fmt.Sprintf("unknown value '%s' (expected '%s')", value, strings.Join(allowed, "', '")))
+}
+
+func (v *Validation) checkDuration(field string, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		v.Add(field, fmt.Sprintf("invalid duration '%s' (e.g. '30s', '5m', '1h30m')", value))
+	}
+}
+
+// findCycle returns the ids of commands that need each other in a cycle, if there's one.
+func findCycle(commands []Command, ids map[string]int) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(commands))
+	var stack []string
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		stack = append(stack, commands[i].ID)
+		for _, need := range commands[i].Needs {
+			j, ok := ids[need]
+			if !ok || j == i {
+				continue
+			}
+			switch state[j] {
+			case visiting:
+				for k, id := range stack {
+					if id == need {
+						return append(append([]string{}, stack[k:]...), need)
+					}
+				}
+			case unvisited:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range commands {
+		if state[i] == unvisited && commands[i].ID != "" {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	commandType   = reflect.TypeOf(Command{})
+	pathEntryType = reflect.TypeOf(PathEntry{})
+)
+
+// checkType reports the fields of a decoded JSON value that are unknown, or of the wrong type.
+func (v *Validation) checkType(value any, t reflect.Type, field string) {
+	// Missing values are left to the semantic checks
+	if value == nil {
+		return
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	wrongType := func() {
+		v.Add(field, fmt.Sprintf("expected %s, got %s", describeType(t), describeValue(value)))
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := value.(string); ok && (t == commandType || t == pathEntryType) {
+			return
+		}
+		obj, ok := value.(map[string]any)
+		if !ok {
+			wrongType()
+			return
+		}
+		fields := jsonFields(t)
+		for key, val := range obj {
+			keyField := key
+			if field != "" {
+				keyField = field + "." + key
+			}
+			f, ok := fields[key]
+			if !ok {
+				message := fmt.Sprintf("unknown field '%s'", key)
+				if suggestion := closestField(key, fields); suggestion != "" {
+					message += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+				}
+				v.Add(keyField, message)
+				continue
+			}
+			v.checkType(val, f.Type, keyField)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			wrongType()
+			return
+		}
+		for key, val := range obj {
+			keyField := key
+			if field != "" {
+				keyField = field + "." + key
+			}
+			v.checkType(val, t.Elem(), keyField)
+		}
+	case reflect.Slice:
+		arr, ok := value.([]any)
+		if !ok {
+			wrongType()
+			return
+		}
+		for i, el := range arr {
+			v.checkType(el, t.Elem(), fmt.Sprintf("%s[%d]", field, i))
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			wrongType()
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			wrongType()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			wrongType()
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			wrongType()
+		}
+	}
+}
+
+// jsonFields returns the fields of a struct by the name they have in the configuration.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" || name == "" {
+			continue
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// closestField returns the field whose name is closest to a misspelled one, if any is close enough.
+func closestField(name string, fields map[string]reflect.StructField) string {
+	best, bestDist := "", 3
+	for candidate := range fields {
+		if d := editDistance(strings.ToLower(name), candidate); d < bestDist || (d == bestDist && candidate < best) {
+			best, bestDist = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func describeType(t reflect.Type) string {
+	switch {
+	case t == commandType:
+		return "a command (string or object)"
+	case t == pathEntryType:
+		return "a path (string or object)"
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Slice:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	default:
+		return "a number"
+	}
+}
+
+func describeValue(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return "a number"
+	}
+}
+
+// indexPositions finds where each field starts in the file.
+func (v *Validation) indexPositions() {
+	dec := json.NewDecoder(bytes.NewReader(v.data))
+
+	var walk func(field string) error
+	walk = func(field string) error {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := v.positions[field]; !ok {
+			v.positions[field] = offset
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				keyOffset := dec.InputOffset()
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				keyField := key.(string)
+				if field != "" {
+					keyField = field + "." + keyField
+				}
+				v.positions[keyField] = keyOffset
+				if err := walk(keyField); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", field, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	walk("")
+}
+
+// position returns the line and column of a field, or of the closest enclosing one that's in the file.
+func (v *Validation) position(field string) (int, int) {
+	for {
+		if offset, ok := v.positions[field]; ok {
+			return v.lineColumn(offset)
+		}
+		if field == "" {
+			return 1, 1
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			field = ""
+		} else {
+			field = field[:i]
+		}
+	}
+}
+
+// lineColumn returns the line and column of the first meaningful character at or after an offset.
+func (v *Validation) lineColumn(offset int64) (int, int) {
+	for offset < int64(len(v.data)) && strings.ContainsRune(" \t\r\n,:", rune(v.data[offset])) {
+		offset++
+	}
+	line, column := 1, 1
+	for i := int64(0); i < offset && i < int64(len(v.data)); i++ {
+		if v.data[i] == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"os/exec"
+	"slices"
+	"testing"
+
+	"github.com/0x07cf-dev/go-backup/internal/utils"
+)
+
+func TestValidateCommandSyntax(t *testing.T) {
+	if _, err := exec.LookPath(utils.DefaultShell); err != nil {
+		t.Skip(err)
+	}
+	data := []byte(`{"machines": [{"hostname": "web-01", "paths": [], "post": [], "pre": [
+		"tar czf app.tgz app & echo done",
+		"pushd (sub) & echo built-ins are no scripts",
+		"echo \"a & b\"",
+		{"run": "echo \"a & b\""},
+		{"run": "echo 'unclosed"}
+	]}]}`)
+	opts := ValidateOpts{IsBuiltin: func(name string) bool { return name == "pushd" }}
+
+	var fields []string
+	for _, p := range Validate(data, opts).Problems {
+		fields = append(fields, p.Field)
+	}
+	// Plain strings are split on '&' before they run, scripts are not
+	want := []string{"machines[0].pre[2]", "machines[0].pre[2]", "machines[0].pre[4].run"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("problems in %q, want %q", fields, want)
+	}
+}
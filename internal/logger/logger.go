@@ -89,41 +89,41 @@ func Initialize(path string, logLevel zerolog.Level, unattended bool) {
 }
 
 func Debug(msg string) {
-	Logger.Debug().Msg(msg)
+	Logger.Debug().Msg(Redact(msg))
 }
 
 func Debugf(format string, args ...interface{}) {
-	Logger.Debug().Msgf(format, args...)
+	Logger.Debug().Msg(Redact(fmt.Sprintf(format, args...)))
 }
 
 func Info(msg string) {
-	Logger.Info().Msg(msg)
+	Logger.Info().Msg(Redact(msg))
 }
 
 func Infof(format string, args ...interface{}) {
-	Logger.Info().Msgf(format, args...)
+	Logger.Info().Msg(Redact(fmt.Sprintf(format, args...)))
 }
 
 func Warn(msg string) {
-	Logger.Warn().Msg(msg)
+	Logger.Warn().Msg(Redact(msg))
 }
 
 func Warnf(format string, args ...interface{}) {
-	Logger.Warn().Msgf(format, args...)
+	Logger.Warn().Msg(Redact(fmt.Sprintf(format, args...)))
 }
 
 func Error(msg string) {
-	Logger.Error().Msg(msg)
+	Logger.Error().Msg(Redact(msg))
 }
 
 func Errorf(format string, args ...interface{}) {
-	Logger.Error().Msgf(format, args...)
+	Logger.Error().Msg(Redact(fmt.Sprintf(format, args...)))
 }
 
 func Fatal(msg string) {
-	Logger.Fatal().Msg(msg)
+	Logger.Fatal().Msg(Redact(msg))
 }
 
 func Fatalf(format string, args ...interface{}) {
-	Logger.Fatal().Msgf(format, args...)
+	Logger.Fatal().Msg(Redact(fmt.Sprintf(format, args...)))
 }
@@ -0,0 +1,163 @@
+package logger
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces secrets in logs, notifications and heartbeats.
+const Mask = "[REDACTED]"
+
+// MinSecretLength is the length of the shortest value that can be masked: shorter ones would be found everywhere.
+const MinSecretLength = 6
+
+// Variables holding secrets, besides those whose name suggests it
+var secretVars = []string{
+	"NTFY_TOKEN",
+	"NTFY_HEALTHCHECKS",
+	"NTFY_BETTERUPTIME",
+	"RCLONE_CONFIG_PASS",
+}
+
+// Parts of variable names that suggest they hold a secret
+var secretHints = []string{
+	"TOKEN",
+	"SECRET",
+	"PASS",
+	"API_KEY",
+	"APIKEY",
+	"ACCESS_KEY",
+	"PRIVATE_KEY",
+	"CREDENTIAL",
+	"AUTH",
+}
+
+var redaction = struct {
+	values   []string
+	patterns []*regexp.Regexp
+	replacer *strings.Replacer
+	mu       sync.RWMutex
+}{}
+
+// IsSecretVar reports whether an environment variable is known to hold a secret, or its name suggests it.
+func IsSecretVar(name string) bool {
+	name = strings.ToUpper(name)
+	for _, v := range secretVars {
+		if name == v {
+			return true
+		}
+	}
+	for _, hint := range secretHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMaskable reports whether a value is long enough to be masked, ignoring the spaces around it.
+func IsMaskable(value string) bool {
+	return len(strings.TrimSpace(value)) >= MinSecretLength
+}
+
+// AddSecret makes a value be masked wherever it appears.
+// It reports false if the value is too short to be masked, and left as it is.
+func AddSecret(value string) bool {
+	if !IsMaskable(value) {
+		return strings.TrimSpace(value) == ""
+	}
+	value = strings.TrimSpace(value)
+
+	redaction.mu.Lock()
+	defer redaction.mu.Unlock()
+	for _, v := range redaction.values {
+		if v == value {
+			return true
+		}
+	}
+	redaction.values = append(redaction.values, value)
+
+	// Longer secrets first, so that those containing others are masked whole
+	sort.Slice(redaction.values, func(i, j int) bool {
+		return len(redaction.values[i]) > len(redaction.values[j])
+	})
+	pairs := make([]string, 0, 2*len(redaction.values))
+	for _, v := range redaction.values {
+		pairs = append(pairs, v, Mask)
+	}
+	redaction.replacer = strings.NewReplacer(pairs...)
+	return true
+}
+
+// AddSecretVars masks the values of the variables that hold secrets, given as KEY=value.
+// It returns the names of those whose values are too short to be masked.
+func AddSecretVars(env []string) []string {
+	var unmasked []string
+	for _, kv := range env {
+		if k, v, found := strings.Cut(kv, "="); found && IsSecretVar(k) && !AddSecret(v) {
+			unmasked = append(unmasked, k)
+		}
+	}
+	return unmasked
+}
+
+// AddPattern masks whatever matches a regular expression. If it has groups, only what they match is masked.
+func AddPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid redaction pattern '%s': %s", pattern, err)
+	}
+
+	redaction.mu.Lock()
+	defer redaction.mu.Unlock()
+	redaction.patterns = append(redaction.patterns, re)
+	return nil
+}
+
+// Redact masks the secrets in a string.
+func Redact(s string) string {
+	redaction.mu.RLock()
+	defer redaction.mu.RUnlock()
+
+	if redaction.replacer != nil {
+		s = redaction.replacer.Replace(s)
+	}
+	for _, re := range redaction.patterns {
+		s = redactPattern(re, s)
+	}
+	return s
+}
+
+func redactPattern(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllString(s, Mask)
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		for g := 1; g <= re.NumSubexp(); g++ {
+			start, end := m[2*g], m[2*g+1]
+			if start < last || start == end {
+				continue
+			}
+			sb.WriteString(s[last:start])
+			sb.WriteString(Mask)
+			last = end
+		}
+	}
+	sb.WriteString(s[last:])
+	return sb.String()
+}
+
+// EnvNames returns the names of the variables of an environment, without their values.
+func EnvNames(env []string) []string {
+	names := make([]string, len(env))
+	for i, kv := range env {
+		names[i], _, _ = strings.Cut(kv, "=")
+	}
+	return names
+}
@@ -61,9 +61,16 @@ func (hm HealthMonitors) getURLForID(id string, endpoint string) *url.URL {
 }
 
 func (hm HealthMonitors) Ping(endpoint string, body *bytes.Buffer) (string, error) {
-	url := hm.getURL(endpoint).String()
+	return hm.ping(hm.getURL(endpoint), body)
+}
+
+// PingID pings the monitor with the given ID, instead of the one in the environment.
+func (hm HealthMonitors) PingID(id string, endpoint string, body *bytes.Buffer) (string, error) {
+	return hm.ping(hm.getURLForID(id, endpoint), body)
+}
 
-	resp, err := httpRequest(monitorParams[hm].Method, url, body, 10, 5, map[string]string{})
+func (hm HealthMonitors) ping(u *url.URL, body *bytes.Buffer) (string, error) {
+	resp, err := httpRequest(monitorParams[hm].Method, u.String(), body, 10, 5, map[string]string{})
 	if err != nil {
 		return "", err
 	}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,6 +20,7 @@ type Notifier struct {
 	Token string
 	// Health
 	HealthMonitors []HealthMonitors
+	MonitorIDs     map[HealthMonitors]string
 }
 
 func NewNotifierFromEnv() (*Notifier, error) {
@@ -59,6 +61,31 @@ func NewNotifier(host string, topic string, token string, healthMonitors ...Heal
 	}, nil
 }
 
+// NewHeartbeatNotifier returns a notifier that only sends heartbeats, for monitors given with UseMonitorIDs
+// when ntfy.sh isn't configured.
+func NewHeartbeatNotifier() *Notifier {
+	return &Notifier{}
+}
+
+// CanSend reports whether the notifier sends messages, besides heartbeats.
+func (notifier *Notifier) CanSend() bool {
+	return notifier.Host != ""
+}
+
+// UseMonitorIDs makes heartbeats ping only the monitors with the given IDs, instead of those in the environment.
+func (notifier *Notifier) UseMonitorIDs(ids map[HealthMonitors]string) {
+	notifier.HealthMonitors = nil
+	notifier.MonitorIDs = make(map[HealthMonitors]string)
+	for mon, id := range ids {
+		if id == "" {
+			continue
+		}
+		notifier.HealthMonitors = append(notifier.HealthMonitors, mon)
+		notifier.MonitorIDs[mon] = id
+	}
+	slices.Sort(notifier.HealthMonitors)
+}
+
 func (notifier *Notifier) SendHeartbeats(endpoint string, withLog bool) (string, error) {
 	resultCh := make(chan string, len(notifier.HealthMonitors))
 	errCh := make(chan error, len(notifier.HealthMonitors))
@@ -72,11 +99,19 @@ func (notifier *Notifier) SendHeartbeats(endpoint string, withLog bool) (string,
 				logger.Errorf("Notifier: error opening log file: %s", err.Error())
 			}
 			defer file.Close()
-			buf.ReadFrom(file)
+			var log bytes.Buffer
+			log.ReadFrom(file)
+			buf.WriteString(logger.Redact(log.String()))
 		}
 
 		// Ping uptime monitor
-		resp, err := mon.Ping(endpoint, &buf)
+		var resp string
+		var err error
+		if id, ok := notifier.MonitorIDs[mon]; ok {
+			resp, err = mon.PingID(id, endpoint, &buf)
+		} else {
+			resp, err = mon.Ping(endpoint, &buf)
+		}
 		if err != nil {
 			errCh <- err
 		}
@@ -105,7 +140,7 @@ func (notifier *Notifier) SendHeartbeats(endpoint string, withLog bool) (string,
 }
 
 func (notifier *Notifier) Send(title string, body string, tags []string, opts ...MsgOptFunc) (string, error) {
-	return notifier.SendMessage(newMessage(notifier.Topic, title, body, tags, opts...))
+	return notifier.SendMessage(newMessage(notifier.Topic, logger.Redact(title), logger.Redact(body), tags, opts...))
 }
 
 func (notifier *Notifier) SendMessage(message *Message) (string, error) {
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ShellCommand returns a command that runs the script with the given shell, or with the system's default one.
+func ShellCommand(ctx context.Context, shell string, script string) *exec.Cmd {
+	if shell == "" {
+		shell = DefaultShell
+	}
+	cmd := exec.CommandContext(ctx, shell, shellFlag(shell), script)
+	KillProcessGroup(cmd)
+	return cmd
+}
+
+// shellFlag returns the option that makes a shell run the script given as argument.
+func shellFlag(shell string) string {
+	switch strings.TrimSuffix(strings.ToLower(filepath.Base(shell)), ".exe") {
+	case "cmd":
+		return "/C"
+	case "powershell", "pwsh":
+		return "-Command"
+	default:
+		return "-c"
+	}
+}
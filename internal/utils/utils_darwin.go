@@ -1,11 +1,17 @@
 package utils
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
+	"time"
 )
 
+// DefaultShell runs the commands that don't specify a shell
+const DefaultShell = "bash"
+
 func CleanPath(p string) (string, error) {
 	// Expand environment variables ($UNIX)
 	res := os.ExpandEnv(p)
@@ -15,9 +21,26 @@ func CleanPath(p string) (string, error) {
 	return res, nil
 }
 
-func ParseCommand(c string) (*exec.Cmd, error) {
-	// Expand environment variables
-	command := os.ExpandEnv(c)
-	systemCmd := exec.Command("bash", "-c", command)
+func ParseCommand(ctx context.Context, c string) (*exec.Cmd, error) {
+	// Expand environment variables. Those that aren't set are left to the shell,
+	// which may find them in the environment the command runs with.
+	command := os.Expand(c, func(key string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		return "${" + key + "}"
+	})
+	systemCmd := exec.CommandContext(ctx, "bash", "-c", command)
+	KillProcessGroup(systemCmd)
 	return systemCmd, nil
 }
+
+// KillProcessGroup makes the command run in its own process group, which is killed
+// as a whole when the command's context is done, taking along whatever it started.
+func KillProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+}
@@ -1,12 +1,18 @@
 package utils
 
 import (
+	"context"
 	"os/exec"
 	"path"
+	"strconv"
+	"time"
 
 	"golang.org/x/sys/windows/registry"
 )
 
+// DefaultShell runs the commands that don't specify a shell
+const DefaultShell = "cmd.exe"
+
 func CleanPath(p string) (string, error) {
 	// Expand environment variables (%WINDOWS%)
 	res, err := registry.ExpandString(p)
@@ -19,13 +25,23 @@ func CleanPath(p string) (string, error) {
 	return res, nil
 }
 
-func ParseCommand(c string) (*exec.Cmd, error) {
+func ParseCommand(ctx context.Context, c string) (*exec.Cmd, error) {
 	// Expand environment variables
 	command, err := registry.ExpandString(c)
 	if err != nil {
 		return nil, err
 	}
 
-	systemCmd := exec.Command("cmd.exe", "/C", command)
+	systemCmd := exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	KillProcessGroup(systemCmd)
 	return systemCmd, nil
 }
+
+// KillProcessGroup makes the command's whole process tree be killed
+// when the command's context is done, taking along whatever it started.
+func KillProcessGroup(cmd *exec.Cmd) {
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+	cmd.WaitDelay = 5 * time.Second
+}